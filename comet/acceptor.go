@@ -0,0 +1,88 @@
+package comet
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+const (
+	// DefaultLoginTimeout 新连接完成登录的超时时间
+	DefaultLoginTimeout = time.Second * 10
+)
+
+// Acceptor 在新连接的首帧上完成握手认证, 返回Channel ID
+// 返回error时Server会回写一个带原因的Close帧并关闭连接
+type Acceptor interface {
+	Accept(conn Conn, timeout time.Duration) (string, error)
+}
+
+// AcceptorFunc 适配普通函数为Acceptor
+type AcceptorFunc func(conn Conn, timeout time.Duration) (string, error)
+
+func (f AcceptorFunc) Accept(conn Conn, timeout time.Duration) (string, error) {
+	return f(conn, timeout)
+}
+
+// defaultAcceptor 不做认证, 为每个连接生成唯一ID
+type defaultAcceptor struct{}
+
+func (defaultAcceptor) Accept(Conn, time.Duration) (string, error) {
+	return ksuid.New().String(), nil
+}
+
+// TokenAcceptor 将首个数据帧的Payload作为token, 交由verify校验并换取用户/会话ID
+func TokenAcceptor(verify func(token string) (string, error)) Acceptor {
+	return AcceptorFunc(func(conn Conn, timeout time.Duration) (string, error) {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+
+		for {
+			frame, err := conn.ReadFrame()
+			if err != nil {
+				return "", err
+			}
+
+			switch frame.Opcode {
+			case OpPing:
+				if err := conn.WriteFrame(Frame{Opcode: OpPong}); err != nil {
+					return "", err
+				}
+				if err := conn.Flush(); err != nil {
+					return "", err
+				}
+				continue
+			case OpPong:
+				continue
+			case OpClose:
+				return "", ErrLoginClosed
+			}
+
+			id, err := verify(string(frame.Payload))
+			if err != nil {
+				return "", errors.Wrap(ErrLoginRejected, err.Error())
+			}
+			if id == "" {
+				return "", errors.Wrap(ErrLoginRejected, "empty id")
+			}
+			return id, nil
+		}
+	})
+}
+
+// HandshakeAcceptor 使用握手阶段提取的数据(如web.Upgrader.OnRequest返回的Metadata)认证, 不读取登录帧
+func HandshakeAcceptor(verify func(hs Handshake) (string, error)) Acceptor {
+	return AcceptorFunc(func(conn Conn, _ time.Duration) (string, error) {
+		id, err := verify(HandshakeOf(conn))
+		if err != nil {
+			return "", errors.Wrap(ErrLoginRejected, err.Error())
+		}
+		if id == "" {
+			return "", errors.Wrap(ErrLoginRejected, "empty id")
+		}
+		return id, nil
+	})
+}
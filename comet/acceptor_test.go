@@ -0,0 +1,139 @@
+package comet
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/longyue0521/Tim/comet/conn/web"
+	"github.com/longyue0521/Tim/comet/internal/testcert"
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyToken(token string) (string, error) {
+	if token != "secret" {
+		return "", errors.New("invalid token")
+	}
+	return "user-1", nil
+}
+
+func TestServer_TokenAcceptor(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{}, WithAcceptor(TokenAcceptor(verifyToken)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// 登录前的Ping也能得到响应
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpPing}))
+	assert.NoError(t, client.Flush())
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, OpPong, f.Opcode)
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpText, Payload: []byte("secret")}))
+	assert.NoError(t, client.Flush())
+	assert.True(t, waitChannels(s, 1))
+
+	ch, ok := s.Pool().Get("user-1")
+	assert.True(t, ok)
+	assert.Equal(t, "user-1", ch.ID())
+}
+
+func TestServer_TokenAcceptor_Reject(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{}, WithAcceptor(TokenAcceptor(verifyToken)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpText, Payload: []byte("bad")}))
+	assert.NoError(t, client.Flush())
+
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, reason, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, ClosePolicyViolation, code)
+	assert.Contains(t, reason, "invalid token")
+	assert.Empty(t, s.Pool().All())
+}
+
+func TestServer_LoginTimeout(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{},
+		WithAcceptor(TokenAcceptor(verifyToken)), WithLoginTimeout(50*time.Millisecond))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// 不发送登录帧, 超时后服务端回写Close帧
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, OpClose, f.Opcode)
+	assert.Empty(t, s.Pool().All())
+}
+
+func TestServer_HandshakeAcceptor(t *testing.T) {
+	upgrader := web.Upgrader{
+		OnRequest: func(r *http.Request) (Metadata, error) {
+			return Metadata{"token": r.URL.Query().Get("token")}, nil
+		},
+	}
+	acceptor := HandshakeAcceptor(func(hs Handshake) (string, error) {
+		return verifyToken(hs.Metadata["token"])
+	})
+	s := NewServer("", upgrader.Upgrade, echoListener{}, WithAcceptor(acceptor))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := web.NewClientConn(fmt.Sprintf("ws://%s/?token=secret", addr))
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, waitChannels(s, 1))
+
+	ch, ok := s.Pool().Get("user-1")
+	assert.True(t, ok)
+	assert.Equal(t, "secret", ch.Handshake().Metadata["token"])
+
+	// 握手数据不合法时回写Close帧
+	bad, err := web.NewClientConn(fmt.Sprintf("ws://%s/?token=bad", addr))
+	assert.NoError(t, err)
+	defer bad.Close()
+	f, err := bad.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, ClosePolicyViolation, code)
+}
+
+func TestServer_HandshakeAcceptor_MTLS(t *testing.T) {
+	certs, err := testcert.New()
+	assert.NoError(t, err)
+
+	upgrader := tcp.Upgrader{TLSConfig: certs.ServerConfig(true)}
+	acceptor := HandshakeAcceptor(func(hs Handshake) (string, error) {
+		return hs.TLS.PeerCertificates[0].Subject.CommonName, nil
+	})
+	s := NewServer("", upgrader.Upgrade, echoListener{}, WithAcceptor(acceptor))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.Dialer{TLSConfig: certs.ClientConfig(true)}.Dial(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, waitChannels(s, 1))
+
+	_, ok := s.Pool().Get("test client")
+	assert.True(t, ok)
+}
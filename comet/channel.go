@@ -2,8 +2,8 @@ package comet
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,68 +19,157 @@ type Agent interface {
 
 // MessageListener 监听消息
 type MessageListener interface {
-	// 收到消息回调
+	// 收到消息回调, 同一Channel的回调由Executor按消息到达顺序串行执行
 	Receive(Agent, []byte)
 }
 
+// MessageListenerFunc 适配普通函数为MessageListener
+type MessageListenerFunc func(Agent, []byte)
+
+func (f MessageListenerFunc) Receive(ag Agent, payload []byte) {
+	f(ag, payload)
+}
+
 type Channel interface {
 	Conn
 	Agent
 	ReadLoop(lst MessageListener) error
+	// CloseWithReason 关闭握手: 写完缓冲区中的消息后发送Close帧, 等待对端回复Close帧或超时后关闭连接
+	CloseWithReason(code CloseCode, reason string) error
 	SetReadTimeout(time.Duration)
 	SetWriteTimeout(time.Duration)
+	// Dropped 因缓冲区满而丢弃的消息数
+	Dropped() uint64
+	// Handshake 底层连接的握手结果, 如子协议与握手时提取的Metadata
+	Handshake() Handshake
 }
 
 const (
 	DefaultReadTimeout  = time.Minute * 3
 	DefaultWriteTimeout = time.Second * 10
+	DefaultCloseTimeout = time.Second * 5
 )
 
 type channel struct {
 	Conn
 	id          string
+	opts        channelOptions
 	payloadChan chan []byte
+	dropped     uint64
+	lastSeen    int64 // UnixNano, 最近一次收到帧的时间
+	pingChan    chan struct{}
+	pings       int   // 连续未得到回复的Ping数, 只在checkHeartbeat中访问
+	pending     int32 // 已提交但未执行完的回调数
+	closeChan   chan closeRequest
+	closing     int32 // 为1时不再接受Push
+	closeSent   int32 // 为1时本端已发送Close帧
+	peerClosed  chan struct{}
+	peerOnce    sync.Once
+	hbTimer     *Timer
+	rtTimer     *Timer
+	hbMu        sync.Mutex // 保护hbTimer与rtTimer
+	rel         *reliable  // 未启用可靠投递时为nil
+	causeMu     sync.Mutex
+	cause       error // 首个导致关闭的原因
 	m           sync.Mutex
+	wm          sync.Mutex
 	once        sync.Once
-	rdTimeout   time.Duration
-	wtTimeout   time.Duration
+	rdTimeout   int64 // time.Duration, 原子读写
+	wtTimeout   int64 // time.Duration, 原子读写
+	log         Logger
+	metrics     Metrics
 	ctx         context.Context
 	ctxCancel   context.CancelFunc
 }
 
-func NewChannel(id string, conn Conn) Channel {
-	// TODO: add log info
-	/*
-		log := logger.WithFields(logger.Fields{
-			"module": "channel",
-			"id":     id,
-		})
-	*/
+// NewChannel 创建Channel并启动写协程, 所有配置在协程启动前完成
+func NewChannel(id string, conn Conn, opts ...ChannelOption) Channel {
+	c := newChannel(id, conn, opts...)
+	c.start()
+	return c
+}
+
+// newChannel 只创建不启动, Server在加入ChannelPool成功后才调用start,
+// 被拒绝的登录不会收到任何消息
+func newChannel(id string, conn Conn, opts ...ChannelOption) *channel {
+	o := defaultChannelOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	c := &channel{
 		id:          id,
 		Conn:        conn,
-		payloadChan: make(chan []byte, 5),
-		rdTimeout:   DefaultReadTimeout,
-		wtTimeout:   DefaultWriteTimeout,
+		opts:        o,
+		payloadChan: make(chan []byte, o.bufferSize),
+		lastSeen:    time.Now().UnixNano(),
+		pingChan:    make(chan struct{}, 1),
+		closeChan:   make(chan closeRequest),
+		peerClosed:  make(chan struct{}),
+		rdTimeout:   int64(o.readTimeout),
+		wtTimeout:   int64(o.writeTimeout),
+		log:         o.logger,
+		metrics:     o.metrics,
 	}
 
-	c.ctx, c.ctxCancel = context.WithCancel(context.Background())
+	c.ctx, c.ctxCancel = context.WithCancel(o.ctx)
+
+	if o.executor == nil {
+		c.opts.executor = sharedWorkerPool()
+	}
 
+	if (o.heartbeatInterval > 0 || o.store != nil) && o.timingWheel == nil {
+		c.opts.timingWheel = sharedTimingWheel()
+	}
+	if o.store != nil {
+		c.rel = newReliable(o.store, o.retransmitTimeout)
+	}
 	return c
 }
 
+// start 启动心跳、重传检测与写协程
+func (c *channel) start() {
+	if c.opts.heartbeatInterval > 0 {
+		c.scheduleHeartbeat()
+	}
+	if c.rel != nil {
+		c.scheduleRetransmit()
+		// 投递离线期间保存的消息
+		c.rel.wakeup()
+	}
+
+	// 写协程随Channel创建而启动, 随Close或父Context结束而退出
+	go func() {
+		defer func() {
+			if err := c.recoverPanic(recover()); err != nil {
+				c.replyClose(NewCloseFrame(CloseInternalServerErr, "internal error"))
+			}
+			// 写失败说明连接已不可用, 关闭Channel让ReadLoop一并退出
+			c.Close()
+		}()
+		if err := c.writeLoop(); err != nil {
+			c.log.Warnf("channel %s write loop exit: %v", c.id, err)
+			c.setCause(err)
+		}
+	}()
+}
+
 func (c *channel) writeLoop() error {
+	var unacked <-chan struct{}
+	if c.rel != nil {
+		unacked = c.rel.notify
+	}
 	for {
 		select {
 		case payload := <-c.payloadChan:
 			//
-			err := c.WriteFrame(Frame{Opcode: OpBinary, Payload: payload})
+			err := c.writePayload(payload)
 			if err != nil {
 				return err
 			}
 			// retrive more payload as possible
-			for i := 0; i < len(c.payloadChan); i++ {
-				err = c.WriteFrame(Frame{Opcode: OpBinary, Payload: <-c.payloadChan})
+			for n := len(c.payloadChan); n > 0; n-- {
+				err = c.writePayload(<-c.payloadChan)
 				if err != nil {
 					return err
 				}
@@ -90,35 +179,222 @@ func (c *channel) writeLoop() error {
 			if err != nil {
 				return err
 			}
+		case <-unacked:
+			if err := c.writeUnacked(); err != nil {
+				return err
+			}
+		case <-c.pingChan:
+			c.log.Debugf("channel %s send ping", c.id)
+			if err := c.WriteFrame(Frame{Opcode: OpPing}); err != nil {
+				return err
+			}
+			if err := c.Flush(); err != nil {
+				return err
+			}
+		case req := <-c.closeChan:
+			err := c.writeClose(req.frame)
+			req.done <- err
+			if err != nil {
+				return err
+			}
+			// Close帧之后不能再发送数据帧, 等待关闭
+			<-c.ctx.Done()
+			return nil
 		case <-c.ctx.Done():
 			return nil
 		}
 	}
 }
 
+// errCloseSent 已发送Close帧后不能再写数据帧
+var errCloseSent = errors.New("comet: close frame already sent")
+
+// writePayload 写出一条消息, 已发送Close帧时丢弃
+// 分片写出期间ReadLoop可能回复Close帧, 此时剩余分片由WriteFrame拒绝, 整条消息计为丢弃
+func (c *channel) writePayload(payload []byte) error {
+	if atomic.LoadInt32(&c.closeSent) == 1 {
+		c.drop()
+		return nil
+	}
+	err := WriteMessage(c, Frame{Opcode: OpBinary, Payload: payload}, c.opts.fragmentSize)
+	if errors.Is(err, errCloseSent) {
+		c.drop()
+		return nil
+	}
+	return err
+}
+
+type closeRequest struct {
+	frame Frame
+	done  chan error
+}
+
+// writeClose 写出缓冲区中剩余的消息, 然后发送Close帧
+func (c *channel) writeClose(f Frame) error {
+	for n := len(c.payloadChan); n > 0; n-- {
+		if err := c.writePayload(<-c.payloadChan); err != nil {
+			return err
+		}
+	}
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		// 对端已先发起关闭并得到回复
+		return nil
+	}
+	if err := c.WriteFrame(f); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// scheduleHeartbeat 在时间轮上登记下一次心跳检测
+func (c *channel) scheduleHeartbeat() {
+	c.hbMu.Lock()
+	defer c.hbMu.Unlock()
+
+	select {
+	case <-c.ctx.Done():
+		return
+	default:
+	}
+	c.hbTimer = c.opts.timingWheel.AfterFunc(c.opts.heartbeatInterval, c.guard(c.checkHeartbeat))
+}
+
+// checkHeartbeat 在时间轮协程中执行, 不能阻塞:
+// 空闲超过一个周期通知写协程发送Ping, 已连续发送heartbeatMisses个Ping仍未收到任何帧时关闭Channel
+func (c *channel) checkHeartbeat() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen)))
+	if idle < c.opts.heartbeatInterval {
+		c.pings = 0
+		c.scheduleHeartbeat()
+		return
+	}
+
+	if c.pings >= c.opts.heartbeatMisses {
+		c.log.Infof("channel %s %v: idle %v", c.id, ErrHeartbeatTimeout, idle)
+		c.setCause(ErrHeartbeatTimeout)
+		go c.Close()
+		return
+	}
+	c.pings++
+	select {
+	case c.pingChan <- struct{}{}:
+	default:
+	}
+	c.scheduleHeartbeat()
+}
+
 func (c *channel) ID() string { return c.id }
 
+func (c *channel) Handshake() Handshake { return HandshakeOf(c.Conn) }
+
+// Push 异步写, 缓冲区满时按PushPolicy处理, 关闭后返回ErrChannelClosed
+// 可靠投递模式下消息写入MessageStore即返回, 不受缓冲区大小与PushPolicy限制
 func (c *channel) Push(payload []byte) error {
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return errors.Wrapf(ErrChannelClosed, "channel %s", c.id)
+	}
+	select {
+	case <-c.ctx.Done():
+		return errors.Wrapf(ErrChannelClosed, "channel %s", c.id)
+	default:
+	}
+
+	if c.rel != nil {
+		return c.pushReliable(payload)
+	}
+
 	select {
+	case c.payloadChan <- payload:
+		return nil
 	case <-c.ctx.Done():
-		return fmt.Errorf("channel %s has closed", c.id)
+		return errors.Wrapf(ErrChannelClosed, "channel %s", c.id)
+	default:
+	}
+
+	switch c.opts.pushPolicy {
+	case PolicyBlock:
+		return c.pushWait(payload)
+	case PolicyDropNewest:
+		c.drop()
+		return nil
+	case PolicyDropOldest:
+		return c.pushDropOldest(payload)
+	case PolicyDisconnect:
+		c.drop()
+		c.log.Warnf("channel %s is a slow consumer, disconnect", c.id)
+		c.setCause(ErrSlowConsumer)
+		c.Close()
+		return errors.Wrapf(ErrSlowConsumer, "channel %s", c.id)
 	default:
-		// 异步写
-		c.payloadChan <- payload
+		c.drop()
+		return errors.Wrapf(ErrChannelFull, "channel %s", c.id)
+	}
+}
+
+func (c *channel) pushWait(payload []byte) error {
+	var timeout <-chan time.Time
+	if c.opts.pushTimeout > 0 {
+		timer := time.NewTimer(c.opts.pushTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c.payloadChan <- payload:
 		return nil
+	case <-c.ctx.Done():
+		return errors.Wrapf(ErrChannelClosed, "channel %s", c.id)
+	case <-timeout:
+		c.drop()
+		return errors.Wrapf(ErrChannelFull, "channel %s", c.id)
+	}
+}
+
+func (c *channel) pushDropOldest(payload []byte) error {
+	for {
+		select {
+		case c.payloadChan <- payload:
+			return nil
+		case <-c.ctx.Done():
+			return errors.Wrapf(ErrChannelClosed, "channel %s", c.id)
+		default:
+		}
+		// 与writeLoop竞争, 取不到说明已被写协程消费, 重试即可
+		select {
+		case <-c.payloadChan:
+			c.drop()
+		default:
+		}
 	}
 }
 
-func (c *channel) ReadLoop(lst MessageListener) error {
+func (c *channel) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+	c.metrics.PushDropped(c.id)
+}
+
+func (c *channel) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// ReadLoop 读取消息交给lst, 直到连接出错或关闭; 发生panic时以CloseInternalServerErr关闭并返回*PanicError
+func (c *channel) ReadLoop(lst MessageListener) (err error) {
 	c.m.Lock()
 	defer c.m.Unlock()
+	defer func() {
+		if perr := c.recoverPanic(recover()); perr != nil {
+			c.replyClose(NewCloseFrame(CloseInternalServerErr, "internal error"))
+			err = perr
+		}
+	}()
 
-	// TODO: add logger
-
+	// 按消息读取, 分片合并后再交给lst
+	r := NewMessageReader(c, c.opts.maxMessageSize)
 	for {
 
-		frame, err := c.ReadFrame()
+		frame, err := r.ReadMessage()
 		if err != nil {
+			c.replyReadError(err)
 			return err
 		}
 
@@ -126,95 +402,211 @@ func (c *channel) ReadLoop(lst MessageListener) error {
 		if frame.Opcode == OpClose {
 			// 这里应该主动关闭吧，而不是抛出错误
 			// 答：通过抛出错误来提醒调用者停止
-			return errors.New("remote close channel")
+			return c.handleClose(frame)
 		}
 		// handle Ping Frame
 		if frame.Opcode == OpPing {
-			// TODO: add log.Trace
-			c.WriteFrame(Frame{Opcode: OpPong})
+			c.log.Debugf("channel %s recv ping", c.id)
+			if err := c.WriteFrame(Frame{Opcode: OpPong}); err == nil {
+				_ = c.Flush()
+			}
 			continue
 		}
 
 		payload := frame.Payload
+		if c.rel != nil {
+			if payload, err = c.receiveReliable(payload); err != nil {
+				c.replyReadError(err)
+				return err
+			}
+		}
 		if len(payload) == 0 {
 			continue
 		}
 
-		// TODO:
-		go lst.Receive(c, payload)
+		// 同一Channel的消息按到达顺序执行, 本Channel积压过多或执行器过载时断开连接
+		if err := c.dispatch(lst, payload); err != nil {
+			c.log.Warnf("channel %s dispatch: %v", c.id, err)
+			c.replyClose(NewCloseFrame(CloseTryAgainLater, err.Error()))
+			return errors.Wrapf(err, "channel %s", c.id)
+		}
 	}
 }
 
-func (c *channel) ReadFrame() (Frame, error) {
-	// error 问题， 如果失败怎么办？
-	_ = c.Conn.SetReadDeadline(time.Now().Add(c.rdTimeout))
-	return c.Conn.ReadFrame()
+// dispatch 将回调提交给Executor, 已提交未执行完的回调超过maxPending时返回ErrExecutorFull
+func (c *channel) dispatch(lst MessageListener, payload []byte) error {
+	if n := atomic.AddInt32(&c.pending, 1); int(n) > c.opts.maxPending {
+		atomic.AddInt32(&c.pending, -1)
+		return errors.Wrapf(ErrExecutorFull, "%d messages pending", n-1)
+	}
+	err := c.opts.executor.Execute(c.id, c.guard(func() {
+		defer atomic.AddInt32(&c.pending, -1)
+		lst.Receive(c, payload)
+	}))
+	if err != nil {
+		atomic.AddInt32(&c.pending, -1)
+	}
+	return err
 }
 
-func (c *channel) WriteFrame(f Frame) error {
-	// error 问题， 如果失败怎么办？
-	c.Conn.SetWriteDeadline(time.Now().Add(c.wtTimeout))
-	return c.Conn.WriteFrame(f)
+// handleClose 处理对端的Close帧, 返回包裹*CloseError的ErrRemoteClosed或ErrProtocol
+func (c *channel) handleClose(frame Frame) error {
+	code, reason, err := ParseCloseFrame(frame)
+	if err != nil {
+		// 非法Close帧, 以错误码回复
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			c.replyClose(NewCloseFrame(ce.Code, ce.Reason))
+		}
+		return err
+	}
+
+	if atomic.LoadInt32(&c.closeSent) == 1 {
+		// 本端发起的关闭握手收到回复
+		c.peerOnce.Do(func() { close(c.peerClosed) })
+	} else {
+		// 对端发起关闭, 回复相同的关闭码
+		c.replyClose(NewCloseFrame(code, ""))
+	}
+	return WrapError(ErrRemoteClosed, &CloseError{Code: code, Reason: reason})
 }
 
-func (c *channel) Close() error {
-	c.once.Do(func() {
-		c.ctxCancel()
-		close(c.payloadChan)
-	})
-	return nil
+// replyReadError 因本端检测到对端违规(帧过大、协议错误)而读失败时, 回复对应关闭码
+func (c *channel) replyReadError(err error) {
+	var ce *CloseError
+	switch {
+	case errors.As(err, &ce):
+		c.replyClose(NewCloseFrame(ce.Code, ce.Reason))
+	case errors.Is(err, ErrProtocol):
+		c.replyClose(NewCloseFrame(CloseProtocolError, ""))
+	}
 }
 
-func (c *channel) SetReadTimeout(t time.Duration) {
-	c.rdTimeout = t
+func (c *channel) replyClose(f Frame) {
+	atomic.StoreInt32(&c.closing, 1)
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return
+	}
+	if err := c.WriteFrame(f); err == nil {
+		_ = c.Flush()
+	}
 }
 
-func (c *channel) SetWriteTimeout(t time.Duration) {
-	c.wtTimeout = t
+// CloseWithReason 发送Close帧并等待对端回复, 超时后直接关闭连接
+func (c *channel) CloseWithReason(code CloseCode, reason string) error {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		// 已在关闭中
+		return c.Close()
+	}
+
+	c.setCause(WrapError(ErrChannelClosed, &CloseError{Code: code, Reason: reason}))
+	req := closeRequest{frame: NewCloseFrame(code, reason), done: make(chan error, 1)}
+	var err error
+	select {
+	case c.closeChan <- req:
+		select {
+		case err = <-req.done:
+		case <-c.ctx.Done():
+		}
+	case <-c.ctx.Done():
+	}
+
+	if err == nil {
+		timer := time.NewTimer(c.opts.closeTimeout)
+		select {
+		case <-c.peerClosed:
+		case <-timer.C:
+			c.log.Debugf("channel %s wait close reply timeout", c.id)
+		case <-c.ctx.Done():
+		}
+		timer.Stop()
+	}
+
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *channel) ReadFrame() (Frame, error) {
+	// error 问题， 如果失败怎么办？
+	_ = c.Conn.SetReadDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&c.rdTimeout))))
+	f, err := c.Conn.ReadFrame()
+	if err != nil {
+		return f, WrapReadError(err)
+	}
+	// 收到任何帧(包括分片)都视为对端存活
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+	c.metrics.FrameReceived(c.id, f.Opcode, len(f.Payload))
+	return f, nil
 }
 
-type ChannelPool interface {
-	Add(Channel)
-	Del(id string)
-	Get(id string) (Channel, bool)
-	All() []Channel
+func (c *channel) WriteFrame(f Frame) error {
+	// writeLoop与ReadLoop(回写Pong)并发写, 需要串行化
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	// replyClose先设置closeSent再加锁写Close帧, 在锁内判断可保证Close帧之后不再写出数据帧
+	if !f.Opcode.IsControl() && atomic.LoadInt32(&c.closeSent) == 1 {
+		return errCloseSent
+	}
+	// error 问题， 如果失败怎么办？
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&c.wtTimeout))))
+	if err := c.Conn.WriteFrame(f); err != nil {
+		return WrapWriteError(err)
+	}
+	c.metrics.FrameSent(c.id, f.Opcode, len(f.Payload))
+	return nil
 }
 
-type pool struct {
-	mp *sync.Map
+// Flush 将Conn缓冲区中的帧写入socket
+func (c *channel) Flush() error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&c.wtTimeout))))
+	return WrapWriteError(c.Conn.Flush())
 }
 
-func NewChannelPool(n int) ChannelPool {
-	return &pool{mp: new(sync.Map)}
+func (c *channel) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.setCause(ErrChannelClosed)
+		// payloadChan不关闭, 避免并发Push向已关闭的chan写入而panic
+		c.ctxCancel()
+		c.hbMu.Lock()
+		if c.hbTimer != nil {
+			c.hbTimer.Stop()
+		}
+		if c.rtTimer != nil {
+			c.rtTimer.Stop()
+		}
+		c.hbMu.Unlock()
+		// 关闭底层连接, 使阻塞在ReadFrame上的ReadLoop返回
+		err = c.Conn.Close()
+	})
+	return err
 }
 
-func (p *pool) Add(c Channel) {
-	if c.ID() == "" {
-		// add logger
+// setCause 记录关闭原因, 只保留第一个
+func (c *channel) setCause(err error) {
+	c.causeMu.Lock()
+	defer c.causeMu.Unlock()
+	if c.cause == nil {
+		c.cause = err
 	}
-	p.mp.Store(c.ID(), c)
 }
 
-func (p *pool) Del(id string) {
-	p.mp.Delete(id)
+func (c *channel) closeCause() error {
+	c.causeMu.Lock()
+	defer c.causeMu.Unlock()
+	return c.cause
 }
 
-func (p *pool) Get(id string) (Channel, bool) {
-	if id == "" {
-		// add logger
-	}
-	v, ok := p.mp.Load(id)
-	if !ok {
-		return nil, false
-	}
-	return v.(Channel), true
+// SetReadTimeout 运行期调整读超时, 创建时的配置应使用WithReadTimeout
+func (c *channel) SetReadTimeout(t time.Duration) {
+	atomic.StoreInt64(&c.rdTimeout, int64(t))
 }
 
-func (p *pool) All() []Channel {
-	chs := make([]Channel, 0)
-	p.mp.Range(func(key interface{}, val interface{}) bool {
-		chs = append(chs, val.(Channel))
-		return true
-	})
-	return chs
+// SetWriteTimeout 运行期调整写超时, 创建时的配置应使用WithWriteTimeout
+func (c *channel) SetWriteTimeout(t time.Duration) {
+	atomic.StoreInt64(&c.wtTimeout, int64(t))
 }
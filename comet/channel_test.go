@@ -0,0 +1,419 @@
+package comet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPipeConns(t *testing.T) (Conn, Conn) {
+	s, c := net.Pipe()
+	server, err := tcp.NewServerConn(s)
+	assert.NoError(t, err)
+	client, err := tcp.NewServerConn(c)
+	assert.NoError(t, err)
+	return server, client
+}
+
+func TestChannel_Push(t *testing.T) {
+	server, client := newPipeConns(t)
+	ch := NewChannel("ch1", server)
+	defer ch.Close()
+
+	// 超过缓冲区大小的消息依然能够全部送达
+	const n = 20
+	go func() {
+		for i := 0; i < n; i++ {
+			for errors.Is(ch.Push([]byte(fmt.Sprint(i))), ErrChannelFull) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, Frame{Opcode: OpBinary, Payload: []byte(fmt.Sprint(i))}, f)
+	}
+}
+
+func TestChannel_PushFull(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server)
+
+	// 对端不读, 写协程阻塞, 缓冲区最终被填满
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = ch.Push([]byte("payload"))
+	}
+	assert.ErrorIs(t, err, ErrChannelFull)
+
+	assert.NoError(t, ch.Close())
+	assert.ErrorIs(t, ch.Push([]byte("payload")), ErrChannelClosed)
+}
+
+func TestChannel_PushAfterClose(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server)
+
+	assert.NoError(t, ch.Close())
+	// 重复关闭、关闭后Push都不应panic
+	assert.NoError(t, ch.Close())
+	for i := 0; i < 10; i++ {
+		assert.ErrorIs(t, ch.Push([]byte("payload")), ErrChannelClosed)
+	}
+}
+
+// fillChannel 让写协程阻塞在第一条消息上, 并填满缓冲区
+func fillChannel(t *testing.T, ch Channel, size int) {
+	c := ch.(*channel)
+	assert.NoError(t, ch.Push([]byte("0")))
+	for i := 0; i < 100 && len(c.payloadChan) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= size; i++ {
+		assert.NoError(t, ch.Push([]byte(fmt.Sprint(i))))
+	}
+}
+
+func TestChannel_PushPolicy(t *testing.T) {
+	const size = 3
+
+	tests := map[string]struct {
+		opts    []ChannelOption
+		wantErr error
+		closed  bool
+	}{
+		"reject":      {opts: []ChannelOption{WithPushPolicy(PolicyReject)}, wantErr: ErrChannelFull},
+		"block":       {opts: []ChannelOption{WithPushPolicy(PolicyBlock), WithPushTimeout(10 * time.Millisecond)}, wantErr: ErrChannelFull},
+		"drop newest": {opts: []ChannelOption{WithPushPolicy(PolicyDropNewest)}},
+		"drop oldest": {opts: []ChannelOption{WithPushPolicy(PolicyDropOldest)}},
+		"disconnect":  {opts: []ChannelOption{WithPushPolicy(PolicyDisconnect)}, wantErr: ErrSlowConsumer, closed: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := newPipeConns(t)
+			defer client.Close()
+			ch := NewChannel("ch1", server, append(tt.opts, WithBufferSize(size))...)
+			defer ch.Close()
+
+			fillChannel(t, ch, size)
+
+			err := ch.Push([]byte("new"))
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, uint64(1), ch.Dropped())
+
+			if tt.closed {
+				assert.ErrorIs(t, ch.Push([]byte("new")), ErrChannelClosed)
+			}
+		})
+	}
+}
+
+func TestChannel_PushDropOldest(t *testing.T) {
+	const size = 3
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithBufferSize(size), WithPushPolicy(PolicyDropOldest))
+	defer ch.Close()
+
+	fillChannel(t, ch, size)
+	assert.NoError(t, ch.Push([]byte("new")))
+
+	// 最早的"1"被丢弃
+	for _, want := range []string{"0", "2", "3", "new"} {
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(f.Payload))
+	}
+}
+
+type countMetrics struct {
+	received, sent, dropped int64
+}
+
+func (m *countMetrics) FrameReceived(string, OpCode, int) { atomic.AddInt64(&m.received, 1) }
+func (m *countMetrics) FrameSent(string, OpCode, int)     { atomic.AddInt64(&m.sent, 1) }
+func (m *countMetrics) PushDropped(string)                { atomic.AddInt64(&m.dropped, 1) }
+
+func TestChannel_WithContext(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := NewChannel("ch1", server, WithContext(ctx))
+
+	// 父Context结束后Channel关闭, 对端读到错误
+	cancel()
+	_, err := client.ReadFrame()
+	assert.Error(t, err)
+	assert.ErrorIs(t, ch.Push([]byte("payload")), ErrChannelClosed)
+}
+
+// idleFor 将Channel最近收到帧的时间回拨d, 配合手动调用checkHeartbeat使测试不依赖时间轮的调度
+func idleFor(c *channel, d time.Duration) {
+	atomic.StoreInt64(&c.lastSeen, time.Now().Add(-d).UnixNano())
+}
+
+func TestChannel_Heartbeat(t *testing.T) {
+	tests := map[string]struct {
+		misses int
+	}{
+		"misses 1": {misses: 1},
+		"misses 3": {misses: 3},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := newPipeConns(t)
+			defer client.Close()
+			// 周期足够长, 时间轮不会在测试期间触发
+			ch := NewChannel("ch1", server, WithHeartbeatInterval(time.Hour), WithHeartbeatMisses(tt.misses))
+			c := ch.(*channel)
+			go ch.ReadLoop(echoListener{})
+
+			// 对端静默时每个周期发送一个Ping
+			for i := 0; i < tt.misses; i++ {
+				idleFor(c, time.Hour)
+				c.checkHeartbeat()
+				f, err := client.ReadFrame()
+				assert.NoError(t, err)
+				assert.Equal(t, OpPing, f.Opcode)
+			}
+
+			// 始终不回复, 下一个周期关闭连接
+			idleFor(c, time.Hour)
+			c.checkHeartbeat()
+			var err error
+			for err == nil {
+				_, err = client.ReadFrame()
+			}
+			assert.ErrorIs(t, ch.Push([]byte("payload")), ErrChannelClosed)
+		})
+	}
+}
+
+func TestChannel_HeartbeatAlive(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithHeartbeatInterval(time.Hour), WithHeartbeatMisses(1))
+	defer ch.Close()
+	c := ch.(*channel)
+	go ch.ReadLoop(echoListener{})
+
+	// 每次收到Ping都回复Pong, 连接持续存活
+	for i := 0; i < 5; i++ {
+		idleFor(c, time.Hour)
+		c.checkHeartbeat()
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, OpPing, f.Opcode)
+		assert.NoError(t, client.WriteFrame(Frame{Opcode: OpPong}))
+		assert.NoError(t, client.Flush())
+
+		// 等待Pong被读取后进入下一个周期
+		for time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen))) >= time.Hour {
+			time.Sleep(time.Millisecond)
+		}
+		c.checkHeartbeat()
+	}
+	assert.NoError(t, ch.Push([]byte("payload")))
+}
+
+func TestChannel_WithMetrics(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	m := &countMetrics{}
+	ch := NewChannel("ch1", server, WithMetrics(m), WithReadTimeout(time.Second), WithWriteTimeout(time.Second))
+	defer ch.Close()
+
+	go ch.ReadLoop(echoListener{})
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, client.Flush())
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(f.Payload))
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&m.received))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&m.sent) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestChannel_CloseWithReason(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithCloseTimeout(time.Second))
+	go ch.ReadLoop(echoListener{})
+
+	// 对端暂不读, 消息积压在缓冲区
+	assert.NoError(t, ch.Push([]byte("1")))
+	assert.NoError(t, ch.Push([]byte("2")))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ch.CloseWithReason(CloseNormalClosure, "bye")
+	}()
+
+	// 先收到积压的消息, 再收到Close帧
+	for _, want := range []string{"1", "2"} {
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(f.Payload))
+	}
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, reason, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseNormalClosure, code)
+	assert.Equal(t, "bye", reason)
+
+	// 关闭过程中不再接受Push
+	assert.ErrorIs(t, ch.Push([]byte("3")), ErrChannelClosed)
+
+	// 回复Close帧后关闭完成
+	assert.NoError(t, client.WriteFrame(NewCloseFrame(code, "")))
+	assert.NoError(t, client.Flush())
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("CloseWithReason did not return after close reply")
+	}
+}
+
+func TestChannel_RemoteClose(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server)
+	defer ch.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ch.ReadLoop(echoListener{})
+	}()
+
+	assert.NoError(t, client.WriteFrame(NewCloseFrame(CloseGoingAway, "leaving")))
+	assert.NoError(t, client.Flush())
+
+	// 服务端回复相同关闭码
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseGoingAway, code)
+
+	err = <-errCh
+	assert.ErrorIs(t, err, ErrRemoteClosed)
+	assert.True(t, IsNormalClose(err))
+	var ce *CloseError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "leaving"}, ce)
+}
+
+// hookConn 每写出一帧后回调
+type hookConn struct {
+	Conn
+	mu      sync.Mutex
+	written []Frame
+	onWrite func(Frame)
+}
+
+func (c *hookConn) WriteFrame(f Frame) error {
+	if err := c.Conn.WriteFrame(f); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.written = append(c.written, f)
+	c.mu.Unlock()
+	c.onWrite(f)
+	return nil
+}
+
+func (c *hookConn) frames() []Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Frame(nil), c.written...)
+}
+
+func TestChannel_FragmentationAfterClose(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	go func() {
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	hc := &hookConn{Conn: server}
+	ch := NewChannel("ch1", hc, WithFragmentSize(2))
+	defer ch.Close()
+	// 写出首个分片后ReadLoop回复了Close帧
+	hc.onWrite = func(f Frame) {
+		if f.More && f.Opcode == OpBinary {
+			atomic.StoreInt32(&ch.(*channel).closeSent, 1)
+		}
+	}
+	assert.NoError(t, ch.Push([]byte("abcdef")))
+
+	for i := 0; i < 100 && ch.Dropped() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), ch.Dropped())
+	assert.Equal(t, []Frame{{Opcode: OpBinary, More: true, Payload: []byte("ab")}}, hc.frames())
+}
+
+func TestChannel_Fragmentation(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithFragmentSize(4), WithMaxMessageSize(16))
+	defer ch.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- ch.ReadLoop(echoListener{})
+	}()
+
+	// 分片发送的消息合并后交给MessageListener, 回写时按4字节分片
+	msg := Frame{Opcode: OpBinary, Payload: []byte("hello world")}
+	assert.NoError(t, WriteMessage(client, msg, 3))
+	assert.NoError(t, client.Flush())
+
+	for _, want := range []Frame{
+		{Opcode: OpBinary, More: true, Payload: []byte("hell")},
+		{Opcode: OpContinuation, More: true, Payload: []byte("o wo")},
+		{Opcode: OpContinuation, Payload: []byte("rld")},
+	} {
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, want, f)
+	}
+
+	// 超过WithMaxMessageSize时以CloseMessageTooBig关闭
+	assert.NoError(t, WriteMessage(client, Frame{Opcode: OpBinary, Payload: make([]byte, 20)}, 8))
+	assert.NoError(t, client.Flush())
+
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseMessageTooBig, code)
+	assert.ErrorIs(t, <-errCh, ErrFrameTooLarge)
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff 指数退避, 第n次重连前等待min(Max, Min*Factor^n), 再随机减少至多Jitter比例避免同时重连
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+	// Jitter 取值[0, 1]
+	Jitter float64
+}
+
+// DefaultBackoff 默认的重连退避策略
+var DefaultBackoff = Backoff{
+	Min:    100 * time.Millisecond,
+	Max:    30 * time.Second,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+// Duration 返回第attempt次(从0开始)重连前的等待时间
+func (b Backoff) Duration(attempt int) time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) || math.IsNaN(d) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d -= d * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
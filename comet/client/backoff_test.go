@@ -0,0 +1,35 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Duration(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+	tests := map[string]struct {
+		attempt int
+		want    time.Duration
+	}{
+		"first":    {attempt: 0, want: 100 * time.Millisecond},
+		"second":   {attempt: 1, want: 200 * time.Millisecond},
+		"third":    {attempt: 2, want: 400 * time.Millisecond},
+		"capped":   {attempt: 4, want: time.Second},
+		"overflow": {attempt: 10000, want: time.Second},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, b.Duration(tt.attempt))
+		})
+	}
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := b.Duration(1)
+		assert.True(t, d > 100*time.Millisecond && d <= 200*time.Millisecond, d)
+	}
+}
@@ -0,0 +1,357 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// DialFunc 建立一条新连接, 如tcp.Dialer.DialContext、web.Dialer.DialContext的简单包装
+type DialFunc func(ctx context.Context) (Conn, error)
+
+// Listener 接收服务端推送的消息, 在读协程中按到达顺序同步调用
+type Listener interface {
+	Receive(c *Client, payload []byte)
+}
+
+// ListenerFunc 适配普通函数为Listener
+type ListenerFunc func(c *Client, payload []byte)
+
+func (f ListenerFunc) Receive(c *Client, payload []byte) {
+	f(c, payload)
+}
+
+// Client 断线自动重连的客户端
+// 每次连接建立后重新登录, 可靠投递模式下从最后确认的序号恢复, 断线期间Send的消息在队列中等待发送
+type Client struct {
+	dial  DialFunc
+	lst   Listener
+	opts  options
+	sendq chan []byte
+	// pending 因连接断开未写成功的消息, 只在写协程中访问, 重连后优先发送
+	pending []byte
+	lastSeq uint64
+	state   int32
+	wm      sync.Mutex
+	mu      sync.Mutex
+	running bool
+	closed  bool
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// NewClient 创建Client, 调用Run后开始连接
+func NewClient(dial DialFunc, lst Listener, opts ...Option) *Client {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Client{
+		dial:  dial,
+		lst:   lst,
+		opts:  o,
+		sendq: make(chan []byte, o.queueSize),
+		quit:  make(chan struct{}),
+	}
+}
+
+// State 当前连接状态
+func (c *Client) State() State {
+	return State(atomic.LoadInt32(&c.state))
+}
+
+// LastSeq 可靠投递模式下最后确认的消息序号
+func (c *Client) LastSeq() uint64 {
+	return atomic.LoadUint64(&c.lastSeq)
+}
+
+// Send 将消息放入待发队列, 连接可用时按顺序发送, 队列满时返回ErrQueueFull
+func (c *Client) Send(payload []byte) error {
+	select {
+	case <-c.quit:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.sendq <- payload:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Run 连接并在断开后按退避策略重连, 直到Close、ctx结束或服务端以ClosePolicyViolation关闭连接
+// (登录被拒绝或被踢下线, 重连没有意义), 后者返回包裹*CloseError的ErrRemoteClosed
+func (c *Client) Run(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	if c.running {
+		c.mu.Unlock()
+		return ErrRunning
+	}
+	c.running = true
+	c.done = make(chan struct{})
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		close(c.done)
+		c.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	attempt := 0
+	for {
+		c.setState(StateConnecting, nil)
+		cn, err := c.connect(ctx)
+		if err == nil {
+			attempt = 0
+			c.setState(StateConnected, nil)
+			err = c.serve(ctx, cn)
+		}
+
+		switch {
+		case c.isClosed():
+			c.setState(StateClosed, nil)
+			return nil
+		case ctx.Err() != nil:
+			c.setState(StateDisconnected, ctx.Err())
+			return ctx.Err()
+		case IsCloseError(err, ClosePolicyViolation):
+			c.setState(StateDisconnected, err)
+			return err
+		}
+		c.setState(StateDisconnected, err)
+
+		timer := time.NewTimer(c.opts.backoff.Duration(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		attempt++
+	}
+}
+
+// Close 停止重连, 已连接时发送Close帧后断开, 并等待Run返回
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	running, done := c.running, c.done
+	c.mu.Unlock()
+
+	if running {
+		<-done
+	} else {
+		c.setState(StateClosed, nil)
+	}
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) setState(s State, err error) {
+	atomic.StoreInt32(&c.state, int32(s))
+	c.opts.stateHook(s, err)
+}
+
+// connect 建立连接并登录, 可靠投递模式下随后发送Resume
+func (c *Client) connect(ctx context.Context) (Conn, error) {
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 登录期间ctx结束时关闭连接, 中断阻塞的读写
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.Close()
+		case <-stop:
+		}
+	}()
+
+	if c.opts.login != nil {
+		if err := c.opts.login(ctx, cn); err != nil {
+			cn.Close()
+			return nil, errors.Wrap(err, "login")
+		}
+	}
+	if c.opts.reliable {
+		resume := SeqMessage{Kind: SeqResume, Seq: c.LastSeq()}
+		if err := c.write(cn, Frame{Opcode: OpBinary, Payload: resume.Encode()}); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// serve 读写协程任一退出即断开连接, 返回先出现的错误
+func (c *Client) serve(ctx context.Context, cn Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 2)
+	go func() {
+		errc <- c.readLoop(cn)
+	}()
+	go func() {
+		errc <- c.writeLoop(ctx, cn)
+	}()
+
+	err := <-errc
+	cancel()
+	cn.Close()
+	if err2 := <-errc; err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (c *Client) writeLoop(ctx context.Context, cn Conn) error {
+	var ping <-chan time.Time
+	if c.opts.pingInterval > 0 {
+		ticker := time.NewTicker(c.opts.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		if c.pending != nil {
+			if err := c.writeData(cn, c.pending); err != nil {
+				return err
+			}
+			c.pending = nil
+		}
+
+		select {
+		case c.pending = <-c.sendq:
+		case <-ping:
+			if err := c.write(cn, Frame{Opcode: OpPing}); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			if c.isClosed() {
+				_ = c.write(cn, NewCloseFrame(CloseNormalClosure, ""))
+			}
+			return nil
+		}
+	}
+}
+
+func (c *Client) readLoop(cn Conn) error {
+	r := NewMessageReader(cn, c.opts.maxMessageSize)
+	for {
+		if c.opts.readTimeout > 0 {
+			_ = cn.SetReadDeadline(time.Now().Add(c.opts.readTimeout))
+		}
+		frame, err := r.ReadMessage()
+		if err != nil {
+			c.replyError(cn, err)
+			return err
+		}
+
+		switch frame.Opcode {
+		case OpPing:
+			if err := c.write(cn, Frame{Opcode: OpPong}); err != nil {
+				return err
+			}
+		case OpPong:
+		case OpClose:
+			code, reason, err := ParseCloseFrame(frame)
+			if err != nil {
+				c.replyError(cn, err)
+				return err
+			}
+			_ = c.write(cn, NewCloseFrame(code, ""))
+			return WrapError(ErrRemoteClosed, &CloseError{Code: code, Reason: reason})
+		default:
+			if err := c.receive(cn, frame.Payload); err != nil {
+				c.replyError(cn, err)
+				return err
+			}
+		}
+	}
+}
+
+// replyError 因对端违规(帧过大、协议错误)而断开时, 回复对应关闭码
+func (c *Client) replyError(cn Conn, err error) {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		_ = c.write(cn, NewCloseFrame(ce.Code, ce.Reason))
+	}
+}
+
+// receive 可靠投递模式下丢弃已确认过的重复消息, 交给lst后再确认
+func (c *Client) receive(cn Conn, payload []byte) error {
+	if !c.opts.reliable {
+		c.lst.Receive(c, payload)
+		return nil
+	}
+
+	m, err := DecodeSeqMessage(payload)
+	if err != nil {
+		return err
+	}
+	if m.Kind != SeqData {
+		return WrapError(ErrProtocol, &CloseError{Code: CloseProtocolError, Reason: "unexpected seq kind"})
+	}
+	if m.Seq == 0 {
+		c.lst.Receive(c, m.Body)
+		return nil
+	}
+	if m.Seq > c.LastSeq() {
+		c.lst.Receive(c, m.Body)
+		atomic.StoreUint64(&c.lastSeq, m.Seq)
+	}
+	ack := SeqMessage{Kind: SeqAck, Seq: c.LastSeq()}
+	return c.write(cn, Frame{Opcode: OpBinary, Payload: ack.Encode()})
+}
+
+func (c *Client) writeData(cn Conn, payload []byte) error {
+	if c.opts.reliable {
+		payload = SeqMessage{Kind: SeqData, Body: payload}.Encode()
+	}
+	return c.write(cn, Frame{Opcode: OpBinary, Payload: payload})
+}
+
+// write 读协程(Pong、Ack)与写协程共用连接, 每帧写完立即Flush
+func (c *Client) write(cn Conn, f Frame) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if err := cn.WriteFrame(f); err != nil {
+		return err
+	}
+	return cn.Flush()
+}
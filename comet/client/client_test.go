@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/longyue0521/Tim/comet"
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+var fastBackoff = Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}
+
+type echoListener struct{}
+
+func (echoListener) Receive(ag comet.Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func startServer(t *testing.T, s *comet.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+
+	go func() {
+		_ = s.Serve(context.Background(), ln)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+	return ln.Addr().String()
+}
+
+func tcpDial(addr string) DialFunc {
+	return func(ctx context.Context) (Conn, error) {
+		return tcp.Dialer{}.DialContext(ctx, addr)
+	}
+}
+
+func receiver() (Listener, chan string) {
+	ch := make(chan string, 16)
+	return ListenerFunc(func(_ *Client, payload []byte) {
+		ch <- string(payload)
+	}), ch
+}
+
+func stateHook() (Option, chan State) {
+	ch := make(chan State, 16)
+	return WithStateHook(func(s State, _ error) {
+		select {
+		case ch <- s:
+		default:
+		}
+	}), ch
+}
+
+func waitState(t *testing.T, ch chan State, want State) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case s := <-ch:
+			if s == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("wait state %s timeout", want)
+		}
+	}
+}
+
+func recv(t *testing.T, ch chan string) string {
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+		return ""
+	}
+}
+
+func runClient(t *testing.T, c *Client) chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Run(context.Background())
+	}()
+	return errc
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	var logins int32
+	s := comet.NewServer("", tcp.NewServerConn, echoListener{},
+		comet.WithAcceptor(comet.TokenAcceptor(func(token string) (string, error) {
+			atomic.AddInt32(&logins, 1)
+			return token, nil
+		})))
+	addr := startServer(t, s)
+
+	lst, received := receiver()
+	hook, states := stateHook()
+	c := NewClient(tcpDial(addr), lst, WithLogin(TokenLogin("u1")), WithBackoff(fastBackoff), hook)
+	errc := runClient(t, c)
+
+	waitState(t, states, StateConnected)
+	assert.NoError(t, c.Send([]byte("hello")))
+	assert.Equal(t, "hello", recv(t, received))
+
+	// 服务端断开后重新连接并登录
+	ch, ok := s.Pool().Get("u1")
+	assert.True(t, ok)
+	assert.NoError(t, ch.Close())
+	waitState(t, states, StateDisconnected)
+	waitState(t, states, StateConnected)
+
+	assert.NoError(t, c.Send([]byte("again")))
+	assert.Equal(t, "again", recv(t, received))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&logins))
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, <-errc)
+	assert.Equal(t, StateClosed, c.State())
+}
+
+func TestClient_QueueWhileDisconnected(t *testing.T) {
+	s := comet.NewServer("", tcp.NewServerConn, echoListener{})
+	addr := startServer(t, s)
+
+	// 前3次连接失败
+	var dials int32
+	dial := func(ctx context.Context) (Conn, error) {
+		if atomic.AddInt32(&dials, 1) <= 3 {
+			return nil, errors.New("unreachable")
+		}
+		return tcpDial(addr)(ctx)
+	}
+	lst, received := receiver()
+	c := NewClient(dial, lst, WithBackoff(fastBackoff), WithQueueSize(2))
+
+	assert.NoError(t, c.Send([]byte("1")))
+	assert.NoError(t, c.Send([]byte("2")))
+	assert.ErrorIs(t, c.Send([]byte("3")), ErrQueueFull)
+
+	errc := runClient(t, c)
+	assert.ElementsMatch(t, []string{"1", "2"}, []string{recv(t, received), recv(t, received)})
+	assert.Equal(t, int32(4), atomic.LoadInt32(&dials))
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, <-errc)
+}
+
+func TestClient_Resume(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+	conns := make(chan Conn)
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sc, err := tcp.NewServerConn(raw)
+			if err != nil {
+				return
+			}
+			conns <- sc
+		}
+	}()
+
+	readSeq := func(sc Conn) SeqMessage {
+		f, err := sc.ReadFrame()
+		assert.NoError(t, err)
+		m, err := DecodeSeqMessage(f.Payload)
+		assert.NoError(t, err)
+		return m
+	}
+	login := func(sc Conn) {
+		f, err := sc.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, "u1", string(f.Payload))
+	}
+	push := func(sc Conn, seq uint64, body string) {
+		m := SeqMessage{Kind: SeqData, Seq: seq, Body: []byte(body)}
+		assert.NoError(t, sc.WriteFrame(Frame{Opcode: OpBinary, Payload: m.Encode()}))
+		assert.NoError(t, sc.Flush())
+	}
+
+	lst, received := receiver()
+	c := NewClient(tcpDial(ln.Addr().String()), lst,
+		WithLogin(TokenLogin("u1")), WithReliable(), WithBackoff(fastBackoff))
+	errc := runClient(t, c)
+
+	sc := <-conns
+	login(sc)
+	assert.Equal(t, SeqMessage{Kind: SeqResume, Seq: 0}, readSeq(sc))
+	push(sc, 1, "a")
+	push(sc, 2, "b")
+	assert.Equal(t, SeqMessage{Kind: SeqAck, Seq: 1}, readSeq(sc))
+	assert.Equal(t, SeqMessage{Kind: SeqAck, Seq: 2}, readSeq(sc))
+	assert.Equal(t, "a", recv(t, received))
+	assert.Equal(t, "b", recv(t, received))
+	assert.NoError(t, sc.Close())
+
+	// 重连后从最后确认的序号恢复, 重复的消息只确认不投递
+	sc = <-conns
+	login(sc)
+	assert.Equal(t, SeqMessage{Kind: SeqResume, Seq: 2}, readSeq(sc))
+	push(sc, 2, "b")
+	push(sc, 3, "c")
+	assert.Equal(t, SeqMessage{Kind: SeqAck, Seq: 2}, readSeq(sc))
+	assert.Equal(t, SeqMessage{Kind: SeqAck, Seq: 3}, readSeq(sc))
+	assert.Equal(t, "c", recv(t, received))
+	assert.Equal(t, uint64(3), c.LastSeq())
+
+	// 上行消息不需要确认
+	assert.NoError(t, c.Send([]byte("x")))
+	assert.Equal(t, SeqMessage{Kind: SeqData, Body: []byte("x")}, readSeq(sc))
+
+	assert.NoError(t, c.Close())
+	assert.NoError(t, <-errc)
+	f, err := sc.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, OpClose, f.Opcode)
+	assert.Len(t, received, 0)
+}
+
+func TestClient_LoginRejected(t *testing.T) {
+	s := comet.NewServer("", tcp.NewServerConn, echoListener{},
+		comet.WithAcceptor(comet.TokenAcceptor(func(string) (string, error) {
+			return "", errors.New("invalid token")
+		})))
+	addr := startServer(t, s)
+
+	lst, _ := receiver()
+	c := NewClient(tcpDial(addr), lst, WithLogin(TokenLogin("bad")), WithBackoff(fastBackoff))
+	err := c.Run(context.Background())
+	assert.ErrorIs(t, err, ErrRemoteClosed)
+	assert.True(t, IsCloseError(err, ClosePolicyViolation))
+	assert.Equal(t, StateDisconnected, c.State())
+}
+
+func TestClient_Close(t *testing.T) {
+	lst, _ := receiver()
+	c := NewClient(tcpDial("127.0.0.1:1"), lst)
+	assert.NoError(t, c.Close())
+	assert.NoError(t, c.Close())
+	assert.Equal(t, StateClosed, c.State())
+	assert.ErrorIs(t, c.Send([]byte("x")), ErrClientClosed)
+	assert.ErrorIs(t, c.Run(context.Background()), ErrClientClosed)
+}
+
+func TestClient_RunContext(t *testing.T) {
+	lst, _ := receiver()
+	c := NewClient(func(context.Context) (Conn, error) {
+		return nil, errors.New("unreachable")
+	}, lst, WithBackoff(fastBackoff))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Run(ctx), context.DeadlineExceeded)
+	assert.Equal(t, StateDisconnected, c.State())
+}
@@ -0,0 +1,12 @@
+package client
+
+import (
+	"github.com/pkg/errors"
+)
+
+// 客户端错误, 均可通过errors.Is判断
+var (
+	ErrClientClosed = errors.New("client: closed")
+	ErrQueueFull    = errors.New("client: send queue full")
+	ErrRunning      = errors.New("client: already running")
+)
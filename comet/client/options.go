@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+const (
+	// DefaultQueueSize 断线期间缓存的待发消息数
+	DefaultQueueSize = 64
+)
+
+// State 客户端连接状态
+type State int32
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// LoginFunc 连接建立后完成登录, 每次重连都会重新调用
+type LoginFunc func(ctx context.Context, c Conn) error
+
+// TokenLogin 将token作为首个数据帧发送, 对应comet.TokenAcceptor
+func TokenLogin(token string) LoginFunc {
+	return func(_ context.Context, c Conn) error {
+		if err := c.WriteFrame(Frame{Opcode: OpText, Payload: []byte(token)}); err != nil {
+			return err
+		}
+		return c.Flush()
+	}
+}
+
+type options struct {
+	login          LoginFunc
+	reliable       bool
+	backoff        Backoff
+	queueSize      int
+	pingInterval   time.Duration
+	readTimeout    time.Duration
+	maxMessageSize int
+	stateHook      func(State, error)
+}
+
+func defaultOptions() options {
+	return options{
+		backoff:        DefaultBackoff,
+		queueSize:      DefaultQueueSize,
+		maxMessageSize: DefaultMaxMessageSize,
+		stateHook:      func(State, error) {},
+	}
+}
+
+// Option 配置Client
+type Option func(*options)
+
+// WithLogin 设置登录, 默认不登录
+func WithLogin(login LoginFunc) Option {
+	return func(o *options) {
+		o.login = login
+	}
+}
+
+// WithReliable 启用可靠投递(服务端需同时启用comet.WithReliable): 收到的消息按序号去重并确认,
+// 重连登录后发送最后确认的序号, 由服务端补发之后的消息
+func WithReliable() Option {
+	return func(o *options) {
+		o.reliable = true
+	}
+}
+
+// WithBackoff 设置重连退避策略
+func WithBackoff(b Backoff) Option {
+	return func(o *options) {
+		if b.Min > 0 && b.Max >= b.Min && b.Factor >= 1 {
+			o.backoff = b
+		}
+	}
+}
+
+// WithQueueSize 设置待发队列大小, 断线期间Send的消息在队列中等待重连
+func WithQueueSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.queueSize = n
+		}
+	}
+}
+
+// WithPingInterval 设置主动发送Ping的间隔, 0表示不发送
+func WithPingInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pingInterval = d
+	}
+}
+
+// WithReadTimeout 超过该时间未收到任何帧则断开重连, 0表示不检测
+// 通常设为服务端心跳间隔或WithPingInterval的数倍
+func WithReadTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = d
+	}
+}
+
+// WithMaxMessageSize 设置合并分片后单条消息的上限
+func WithMaxMessageSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxMessageSize = n
+		}
+	}
+}
+
+// WithStateHook 设置状态变化回调, 断开时err为断开原因
+func WithStateHook(hook func(s State, err error)) Option {
+	return func(o *options) {
+		if hook != nil {
+			o.stateHook = hook
+		}
+	}
+}
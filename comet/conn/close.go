@@ -0,0 +1,133 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// CloseCode 关闭码, 与RFC 6455 7.4一致, TCP与WebSocket共用
+type CloseCode uint16
+
+const (
+	CloseNormalClosure           CloseCode = 1000
+	CloseGoingAway               CloseCode = 1001
+	CloseProtocolError           CloseCode = 1002
+	CloseUnsupportedData         CloseCode = 1003
+	CloseNoStatusReceived        CloseCode = 1005 // 仅本地使用, 不出现在帧中
+	CloseAbnormalClosure         CloseCode = 1006 // 仅本地使用, 不出现在帧中
+	CloseInvalidFramePayloadData CloseCode = 1007
+	ClosePolicyViolation         CloseCode = 1008
+	CloseMessageTooBig           CloseCode = 1009
+	CloseMandatoryExtension      CloseCode = 1010
+	CloseInternalServerErr       CloseCode = 1011
+	CloseServiceRestart          CloseCode = 1012
+	CloseTryAgainLater           CloseCode = 1013
+	CloseTLSHandshake            CloseCode = 1015 // 仅本地使用, 不出现在帧中
+)
+
+// maxCloseReasonSize 控制帧Payload不超过125字节, 去掉2字节关闭码
+const maxCloseReasonSize = 123
+
+// CloseError 收到或发送Close帧时的错误, 携带关闭码与原因
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("conn: close %d", e.Code)
+	}
+	return fmt.Sprintf("conn: close %d (%s)", e.Code, e.Reason)
+}
+
+// NewCloseFrame 构造Close帧, Payload为2字节大端关闭码+UTF-8原因
+// 仅本地使用的关闭码构造出空Payload的Close帧
+func NewCloseFrame(code CloseCode, reason string) Frame {
+	switch code {
+	case CloseNoStatusReceived, CloseAbnormalClosure, CloseTLSHandshake:
+		return Frame{Opcode: OpClose}
+	}
+	if len(reason) > maxCloseReasonSize {
+		reason = reason[:maxCloseReasonSize]
+		// 截断不能破坏UTF-8编码
+		for len(reason) > 0 && !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return Frame{Opcode: OpClose, Payload: payload}
+}
+
+// ParseCloseFrame 解析Close帧, 空Payload视为CloseNoStatusReceived
+// Payload非法时返回ErrProtocol, 其中包裹的*CloseError为应当回复给对端的关闭码
+func ParseCloseFrame(f Frame) (CloseCode, string, error) {
+	if f.Opcode != OpClose {
+		return 0, "", errors.Wrapf(ErrInvalidOpCode, "not a close frame: %#x", f.Opcode)
+	}
+	switch {
+	case len(f.Payload) == 0:
+		return CloseNoStatusReceived, "", nil
+	case len(f.Payload) == 1:
+		return 0, "", WrapError(ErrProtocol, &CloseError{Code: CloseProtocolError, Reason: "invalid close payload"})
+	}
+
+	code := CloseCode(binary.BigEndian.Uint16(f.Payload))
+	if !isValidReceivedCloseCode(code) {
+		return 0, "", WrapError(ErrProtocol, &CloseError{Code: CloseProtocolError, Reason: fmt.Sprintf("invalid close code %d", code)})
+	}
+	reason := f.Payload[2:]
+	if !utf8.Valid(reason) {
+		return 0, "", WrapError(ErrProtocol, &CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid utf8 close reason"})
+	}
+	return code, string(reason), nil
+}
+
+func isValidReceivedCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		// 3000-3999由库/框架注册, 4000-4999供应用私有使用
+		return true
+	case code < 1000 || code > 1013:
+		return false
+	}
+	switch code {
+	case 1004, CloseNoStatusReceived, CloseAbnormalClosure:
+		return false
+	}
+	return true
+}
+
+// IsCloseError err为CloseError且关闭码为codes之一时返回true, codes为空时只判断类型
+func IsCloseError(err error, codes ...CloseCode) bool {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	if len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNormalClose 对端正常关闭(1000/1001)或未携带关闭码
+func IsNormalClose(err error) bool {
+	return IsCloseError(err, CloseNormalClosure, CloseGoingAway, CloseNoStatusReceived)
+}
+
+// IsTimeout 读写超时
+func IsTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,94 @@
+package conn
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCloseFrame_ParseCloseFrame(t *testing.T) {
+	type args struct {
+		code   CloseCode
+		reason string
+	}
+
+	tests := map[string]struct {
+		args       args
+		wantCode   CloseCode
+		wantReason string
+	}{
+		"normal closure":       {args{CloseNormalClosure, "bye"}, CloseNormalClosure, "bye"},
+		"without reason":       {args{CloseGoingAway, ""}, CloseGoingAway, ""},
+		"application code":     {args{CloseCode(4000), "kicked"}, CloseCode(4000), "kicked"},
+		"try again later":      {args{CloseTryAgainLater, "busy"}, CloseTryAgainLater, "busy"},
+		"no status received":   {args{CloseNoStatusReceived, "ignored"}, CloseNoStatusReceived, ""},
+		"abnormal closure":     {args{CloseAbnormalClosure, "ignored"}, CloseNoStatusReceived, ""},
+		"truncate reason":      {args{CloseMessageTooBig, strings.Repeat("a", 200)}, CloseMessageTooBig, strings.Repeat("a", maxCloseReasonSize)},
+		"truncate utf8 reason": {args{ClosePolicyViolation, strings.Repeat("中", 50)}, ClosePolicyViolation, strings.Repeat("中", 41)},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := NewCloseFrame(tt.args.code, tt.args.reason)
+			assert.Equal(t, OpClose, f.Opcode)
+			assert.LessOrEqual(t, len(f.Payload), 125)
+
+			code, reason, err := ParseCloseFrame(f)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCode, code)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestParseCloseFrame_Invalid(t *testing.T) {
+	tests := map[string]struct {
+		frame    Frame
+		wantCode CloseCode
+	}{
+		"one byte payload":   {Frame{Opcode: OpClose, Payload: []byte{0x03}}, CloseProtocolError},
+		"reserved code 1004": {Frame{Opcode: OpClose, Payload: []byte{0x03, 0xec}}, CloseProtocolError},
+		"local code 1006":    {Frame{Opcode: OpClose, Payload: []byte{0x03, 0xee}}, CloseProtocolError},
+		"code 999":           {Frame{Opcode: OpClose, Payload: []byte{0x03, 0xe7}}, CloseProtocolError},
+		"code 1014":          {Frame{Opcode: OpClose, Payload: []byte{0x03, 0xf6}}, CloseProtocolError},
+		"invalid utf8":       {Frame{Opcode: OpClose, Payload: []byte{0x03, 0xe8, 0xff}}, CloseInvalidFramePayloadData},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := ParseCloseFrame(tt.frame)
+			assert.ErrorIs(t, err, ErrProtocol)
+			assert.True(t, IsCloseError(err, tt.wantCode))
+		})
+	}
+
+	_, _, err := ParseCloseFrame(Frame{Opcode: OpBinary})
+	assert.ErrorIs(t, err, ErrInvalidOpCode)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestIsCloseError_IsNormalClose_IsTimeout(t *testing.T) {
+	normal := errors.Wrap(&CloseError{Code: CloseNormalClosure}, "read loop")
+	protocol := &CloseError{Code: CloseProtocolError}
+	timeout := errors.Wrap(timeoutError{}, "read frame")
+
+	assert.True(t, IsCloseError(normal))
+	assert.True(t, IsCloseError(normal, CloseGoingAway, CloseNormalClosure))
+	assert.False(t, IsCloseError(normal, CloseProtocolError))
+	assert.False(t, IsCloseError(timeout))
+
+	assert.True(t, IsNormalClose(normal))
+	assert.False(t, IsNormalClose(protocol))
+	assert.False(t, IsNormalClose(timeout))
+
+	assert.True(t, IsTimeout(timeout))
+	assert.False(t, IsTimeout(normal))
+}
@@ -0,0 +1,138 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyFunc 返回连接address时使用的代理, 返回nil表示直连, 目前支持http(CONNECT)代理
+type ProxyFunc func(address string) (*url.URL, error)
+
+// ProxyURL 总是使用u作为代理
+func ProxyURL(u *url.URL) ProxyFunc {
+	return func(string) (*url.URL, error) {
+		return u, nil
+	}
+}
+
+// ProxyFromEnvironment 按HTTPS_PROXY与NO_PROXY环境变量选择代理, 规则与http.ProxyFromEnvironment一致
+func ProxyFromEnvironment(address string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+}
+
+// DialTCP 使用dialer建立到address的TCP连接, proxy返回代理时通过代理建立隧道
+// ctx同时限制连接代理与隧道握手的时间
+func DialTCP(ctx context.Context, dialer *net.Dialer, proxy ProxyFunc, address string) (net.Conn, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	var proxyURL *url.URL
+	if proxy != nil {
+		u, err := proxy(address)
+		if err != nil {
+			return nil, err
+		}
+		proxyURL = u
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	if proxyURL.Scheme != "http" {
+		return nil, errors.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := interruptOnDone(ctx, conn)
+	tunnel, err := httpConnect(conn, proxyURL, address)
+	if serr := stop(); serr != nil {
+		err = serr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// httpConnect 发送CONNECT请求建立隧道
+func httpConnect(conn net.Conn, proxyURL *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("proxy %s: %s", proxyURL.Host, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// 代理在响应后紧跟着转发了目标的数据
+		return &bufferedConn{Conn: conn, r: io.MultiReader(br, conn)}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// interruptOnDone ctx结束时设置过去的Deadline中断conn上阻塞的读写
+// 返回的stop等待监听结束并清除Deadline, ctx已结束时返回ctx.Err()
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	quit := make(chan struct{})
+	exited := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+			exited <- ctx.Err()
+		case <-quit:
+			exited <- nil
+		}
+	}()
+	return func() error {
+		close(quit)
+		err := <-exited
+		_ = conn.SetDeadline(time.Time{})
+		return err
+	}
+}
@@ -0,0 +1,119 @@
+package conn
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startProxy 启动只支持CONNECT的http代理, auth非空时校验Proxy-Authorization
+func startProxy(t *testing.T, auth string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialTCP_Proxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.WriteString(conn, "hello")
+			conn.Close()
+		}
+	}()
+
+	proxy := startProxy(t, "Basic dXNlcjpwYXNz")
+	closed, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	assert.NoError(t, closed.Close())
+	tests := map[string]struct {
+		proxy   ProxyFunc
+		wantErr bool
+	}{
+		"direct":            {proxy: nil},
+		"no proxy":          {proxy: func(string) (*url.URL, error) { return nil, nil }},
+		"http proxy":        {proxy: ProxyURL(&url.URL{Scheme: "http", Host: proxy, User: url.UserPassword("user", "pass")})},
+		"proxy auth":        {proxy: ProxyURL(&url.URL{Scheme: "http", Host: proxy}), wantErr: true},
+		"unsupported":       {proxy: ProxyURL(&url.URL{Scheme: "socks5", Host: proxy}), wantErr: true},
+		"proxy unreachable": {proxy: ProxyURL(&url.URL{Scheme: "http", Host: closed.Addr().String()}), wantErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := DialTCP(context.Background(), nil, tt.proxy, target.Addr().String())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer conn.Close()
+			data, err := io.ReadAll(conn)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+		})
+	}
+}
+
+func TestDialTCP_ProxyTimeout(t *testing.T) {
+	// 代理接受连接但不响应CONNECT
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = DialTCP(ctx, nil, ProxyURL(&url.URL{Scheme: "http", Host: ln.Addr().String()}), "example.com:80")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, IsTimeout(err))
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+}
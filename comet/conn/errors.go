@@ -0,0 +1,81 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// 传输层错误分类, 均可通过errors.Is判断,
+// 实际返回的错误通过WrapError包裹底层错误, errors.As/errors.Cause仍可取得原始错误
+var (
+	ErrInvalid         = errors.New("conn: invalid argument")
+	ErrInvalidOpCode   = errors.New("conn: invalid opcode")
+	ErrDialFailed      = errors.New("conn: dial failed")
+	ErrHandshakeFailed = errors.New("conn: handshake failed")
+	ErrFrameTooLarge   = errors.New("conn: frame too large")
+	ErrProtocol        = errors.New("conn: protocol error")
+	ErrRemoteClosed    = errors.New("conn: remote closed")
+	ErrTimeout         = errors.New("conn: i/o timeout")
+)
+
+// Error 错误分类与底层错误的组合
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// WrapError 以kind分类包裹err, err为nil时返回nil
+func WrapError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Is 使errors.Is(err, kind)成立
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap 使errors.Is/errors.As可以继续匹配底层错误
+func (e *Error) Unwrap() error { return e.Err }
+
+// Cause 兼容github.com/pkg/errors.Cause
+func (e *Error) Cause() error { return e.Err }
+
+// NewFrameTooLargeError 帧超过size上限, 包裹的*CloseError为应当回复给对端的关闭码
+func NewFrameTooLargeError(length uint64, size int) error {
+	return WrapError(ErrFrameTooLarge, &CloseError{
+		Code:   CloseMessageTooBig,
+		Reason: fmt.Sprintf("frame size %d exceeds limit %d", length, size),
+	})
+}
+
+// WrapReadError 对读错误分类: 对端关闭连接为ErrRemoteClosed, 超时为ErrTimeout
+func WrapReadError(err error) error {
+	var e *Error
+	switch {
+	case err == nil, errors.As(err, &e):
+		return err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return WrapError(ErrRemoteClosed, err)
+	case IsTimeout(err):
+		return WrapError(ErrTimeout, err)
+	}
+	return err
+}
+
+// WrapWriteError 对写错误分类: 超时为ErrTimeout
+func WrapWriteError(err error) error {
+	var e *Error
+	if !errors.As(err, &e) && IsTimeout(err) {
+		return WrapError(ErrTimeout, err)
+	}
+	return err
+}
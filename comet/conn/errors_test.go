@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapError(t *testing.T) {
+	assert.Nil(t, WrapError(ErrDialFailed, nil))
+
+	cause := &CloseError{Code: CloseGoingAway}
+	err := errors.Wrap(WrapError(ErrRemoteClosed, cause), "read loop")
+
+	assert.ErrorIs(t, err, ErrRemoteClosed)
+	assert.NotErrorIs(t, err, ErrTimeout)
+
+	var ce *CloseError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, cause, ce)
+	assert.Equal(t, cause, errors.Cause(err))
+	assert.Equal(t, "read loop: conn: remote closed: conn: close 1001", err.Error())
+}
+
+func TestWrapReadError_WrapWriteError(t *testing.T) {
+	other := errors.New("other")
+
+	tests := map[string]struct {
+		err      error
+		wantKind error
+	}{
+		"nil":            {nil, nil},
+		"eof":            {io.EOF, ErrRemoteClosed},
+		"unexpected eof": {errors.Wrap(io.ErrUnexpectedEOF, "decode"), ErrRemoteClosed},
+		"timeout":        {timeoutError{}, ErrTimeout},
+		"wrapped":        {WrapError(ErrProtocol, io.EOF), ErrProtocol},
+		"other":          {other, nil},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := WrapReadError(tt.err)
+			if tt.wantKind == nil {
+				assert.Equal(t, tt.err, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantKind)
+			assert.ErrorIs(t, err, errors.Cause(tt.err))
+		})
+	}
+
+	assert.ErrorIs(t, WrapWriteError(timeoutError{}), ErrTimeout)
+	assert.Equal(t, io.EOF, WrapWriteError(io.EOF))
+}
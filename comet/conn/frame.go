@@ -1,11 +1,14 @@
 package conn
 
-import (
-	"errors"
-)
-
 type OpCode byte
 
+const (
+	// DefaultMaxFrameSize 默认单帧Payload上限, 超过时读取方返回ErrFrameTooLarge
+	DefaultMaxFrameSize = 1 << 20
+	// DefaultMaxMessageSize 默认合并分片后单条消息的上限
+	DefaultMaxMessageSize = 4 << 20
+)
+
 // Opcode type
 const (
 	OpContinuation OpCode = 0x0
@@ -25,14 +28,19 @@ var opCodes = map[OpCode]struct{}{
 	OpPong:         {},
 }
 
-var ErrInvalidOpCode = errors.New("Invalid OpCode")
-
 func IsValidOpCode(code OpCode) bool {
 	_, ok := opCodes[code]
 	return ok
 }
 
 type Frame struct {
-	Opcode  OpCode
+	Opcode OpCode
+	// More 为true表示后续还有分片(对应WebSocket的FIN=0), 零值表示完整的帧
+	More    bool
 	Payload []byte
 }
+
+// IsControl 是否为控制帧, 控制帧不能分片
+func (op OpCode) IsControl() bool {
+	return op&0x8 != 0
+}
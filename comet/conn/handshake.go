@@ -0,0 +1,30 @@
+package conn
+
+import "crypto/tls"
+
+// Metadata 握手阶段提取的连接数据, 例如鉴权token、设备标识
+type Metadata map[string]string
+
+// Handshake 建立连接时的握手结果, 供创建Channel的代码(如Acceptor)使用
+type Handshake struct {
+	// Protocol 协商的子协议, 未协商时为空
+	Protocol string
+	// Metadata 握手校验时提取的数据
+	Metadata Metadata
+	// TLS 使用TLS时的连接状态, 其中PeerCertificates为mTLS对端证书; 未使用TLS时为nil
+	TLS *tls.ConnectionState
+}
+
+// HandshakeConn 携带握手结果的Conn
+type HandshakeConn interface {
+	Conn
+	Handshake() Handshake
+}
+
+// HandshakeOf 返回c的握手结果, c未携带握手结果(如tcp连接)时返回零值
+func HandshakeOf(c Conn) Handshake {
+	if hc, ok := c.(HandshakeConn); ok {
+		return hc.Handshake()
+	}
+	return Handshake{}
+}
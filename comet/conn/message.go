@@ -0,0 +1,92 @@
+package conn
+
+import (
+	"github.com/pkg/errors"
+)
+
+// MessageReader 在Conn之上按消息读取: 将首帧+Continuation分片合并为一条消息
+// 分片之间穿插的控制帧会立即返回, 不影响正在合并的消息
+type MessageReader struct {
+	conn    Conn
+	maxSize int
+
+	op      OpCode
+	buf     []byte
+	pending bool
+}
+
+// NewMessageReader maxSize为合并后消息的上限, <=0时使用DefaultMaxMessageSize
+func NewMessageReader(conn Conn, maxSize int) *MessageReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &MessageReader{conn: conn, maxSize: maxSize}
+}
+
+// ReadMessage 返回一条完整的数据消息或一个控制帧, 返回的Frame.More总为false
+func (r *MessageReader) ReadMessage() (Frame, error) {
+	for {
+		f, err := r.conn.ReadFrame()
+		if err != nil {
+			return Frame{}, err
+		}
+
+		if f.Opcode.IsControl() {
+			if f.More {
+				return Frame{}, protocolError("fragmented control frame")
+			}
+			return f, nil
+		}
+
+		if f.Opcode == OpContinuation {
+			if !r.pending {
+				return Frame{}, protocolError("unexpected continuation frame")
+			}
+		} else {
+			if r.pending {
+				return Frame{}, protocolError("expected continuation frame")
+			}
+			if !f.More {
+				// 未分片的消息直接返回, 不拷贝
+				return f, nil
+			}
+			r.op, r.buf, r.pending = f.Opcode, r.buf[:0], true
+		}
+
+		if len(r.buf)+len(f.Payload) > r.maxSize {
+			return Frame{}, NewFrameTooLargeError(uint64(len(r.buf)+len(f.Payload)), r.maxSize)
+		}
+		r.buf = append(r.buf, f.Payload...)
+
+		if !f.More {
+			msg := Frame{Opcode: r.op, Payload: make([]byte, len(r.buf))}
+			copy(msg.Payload, r.buf)
+			r.buf, r.pending = r.buf[:0], false
+			return msg, nil
+		}
+	}
+}
+
+func protocolError(reason string) error {
+	return WrapError(ErrProtocol, &CloseError{Code: CloseProtocolError, Reason: reason})
+}
+
+// WriteMessage 写一条消息, Payload超过fragmentSize时拆分为首帧+Continuation分片
+// fragmentSize<=0或f为控制帧时不分片, 写入后需调用Flush
+func WriteMessage(conn Conn, f Frame, fragmentSize int) error {
+	if f.More {
+		return errors.Wrap(ErrInvalid, "conn: WriteMessage with fragment frame")
+	}
+	if fragmentSize <= 0 || f.Opcode.IsControl() || len(f.Payload) <= fragmentSize {
+		return conn.WriteFrame(f)
+	}
+
+	op, payload := f.Opcode, f.Payload
+	for len(payload) > fragmentSize {
+		if err := conn.WriteFrame(Frame{Opcode: op, More: true, Payload: payload[:fragmentSize]}); err != nil {
+			return err
+		}
+		op, payload = OpContinuation, payload[fragmentSize:]
+	}
+	return conn.WriteFrame(Frame{Opcode: OpContinuation, Payload: payload})
+}
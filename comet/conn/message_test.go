@@ -0,0 +1,159 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// frameConn 按顺序返回frames, 读完后返回io.EOF; 写入的帧记录在written中
+type frameConn struct {
+	net.Conn
+	frames  []Frame
+	written []Frame
+}
+
+func (c *frameConn) ReadFrame() (Frame, error) {
+	if len(c.frames) == 0 {
+		return Frame{}, io.EOF
+	}
+	f := c.frames[0]
+	c.frames = c.frames[1:]
+	return f, nil
+}
+
+func (c *frameConn) WriteFrame(f Frame) error {
+	c.written = append(c.written, f)
+	return nil
+}
+
+func (c *frameConn) Flush() error {
+	return nil
+}
+
+func TestMessageReader(t *testing.T) {
+	tests := map[string]struct {
+		frames  []Frame
+		maxSize int
+		want    []Frame
+		wantErr error
+	}{
+		"unfragmented": {
+			frames: []Frame{{Opcode: OpBinary, Payload: []byte("abc")}},
+			want:   []Frame{{Opcode: OpBinary, Payload: []byte("abc")}},
+		},
+		"fragmented": {
+			frames: []Frame{
+				{Opcode: OpText, More: true, Payload: []byte("ab")},
+				{Opcode: OpContinuation, More: true},
+				{Opcode: OpContinuation, Payload: []byte("c")},
+			},
+			want: []Frame{{Opcode: OpText, Payload: []byte("abc")}},
+		},
+		"interleaved control frame": {
+			frames: []Frame{
+				{Opcode: OpBinary, More: true, Payload: []byte("ab")},
+				{Opcode: OpPing, Payload: []byte("p")},
+				{Opcode: OpContinuation, Payload: []byte("c")},
+				{Opcode: OpBinary, Payload: []byte("d")},
+			},
+			want: []Frame{
+				{Opcode: OpPing, Payload: []byte("p")},
+				{Opcode: OpBinary, Payload: []byte("abc")},
+				{Opcode: OpBinary, Payload: []byte("d")},
+			},
+		},
+		"unexpected continuation": {
+			frames:  []Frame{{Opcode: OpContinuation, Payload: []byte("c")}},
+			wantErr: ErrProtocol,
+		},
+		"data frame inside fragmented message": {
+			frames: []Frame{
+				{Opcode: OpText, More: true, Payload: []byte("ab")},
+				{Opcode: OpText, Payload: []byte("c")},
+			},
+			wantErr: ErrProtocol,
+		},
+		"fragmented control frame": {
+			frames:  []Frame{{Opcode: OpPing, More: true}},
+			wantErr: ErrProtocol,
+		},
+		"message too large": {
+			frames: []Frame{
+				{Opcode: OpBinary, More: true, Payload: []byte("ab")},
+				{Opcode: OpContinuation, Payload: []byte("cd")},
+			},
+			maxSize: 3,
+			wantErr: ErrFrameTooLarge,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewMessageReader(&frameConn{frames: tt.frames}, tt.maxSize)
+			for _, want := range tt.want {
+				f, err := r.ReadMessage()
+				assert.NoError(t, err)
+				assert.Equal(t, want, f)
+			}
+			_, err := r.ReadMessage()
+			if tt.wantErr == nil {
+				assert.ErrorIs(t, err, io.EOF)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			var ce *CloseError
+			assert.True(t, errors.As(err, &ce))
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	tests := map[string]struct {
+		frame        Frame
+		fragmentSize int
+		want         []Frame
+	}{
+		"no fragment": {
+			frame: Frame{Opcode: OpBinary, Payload: []byte("abcde")},
+			want:  []Frame{{Opcode: OpBinary, Payload: []byte("abcde")}},
+		},
+		"smaller than fragment size": {
+			frame:        Frame{Opcode: OpBinary, Payload: []byte("abc")},
+			fragmentSize: 3,
+			want:         []Frame{{Opcode: OpBinary, Payload: []byte("abc")}},
+		},
+		"fragmented": {
+			frame:        Frame{Opcode: OpText, Payload: []byte("abcde")},
+			fragmentSize: 2,
+			want: []Frame{
+				{Opcode: OpText, More: true, Payload: []byte("ab")},
+				{Opcode: OpContinuation, More: true, Payload: []byte("cd")},
+				{Opcode: OpContinuation, Payload: []byte("e")},
+			},
+		},
+		"control frame": {
+			frame:        Frame{Opcode: OpPing, Payload: []byte("abcde")},
+			fragmentSize: 2,
+			want:         []Frame{{Opcode: OpPing, Payload: []byte("abcde")}},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &frameConn{}
+			assert.NoError(t, WriteMessage(c, tt.frame, tt.fragmentSize))
+			assert.Equal(t, tt.want, c.written)
+
+			// 写出的分片可以被MessageReader还原
+			r := NewMessageReader(&frameConn{frames: c.written}, 0)
+			f, err := r.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.frame, f)
+		})
+	}
+
+	assert.ErrorIs(t, WriteMessage(&frameConn{}, Frame{Opcode: OpBinary, More: true}, 0), ErrInvalid)
+}
@@ -0,0 +1,70 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SeqKind 可靠投递模式下数据帧Payload的首字节, 表示消息类型
+//
+// 可靠投递模式下所有数据帧的Payload格式为(整数均为大端序):
+//
+//	+--------+------------------+-----------+
+//	|  kind  |       seq        |   body    |
+//	| 1 byte |     8 bytes      |           |
+//	+--------+------------------+-----------+
+type SeqKind byte
+
+const (
+	// SeqData 数据消息, seq为0表示不需要确认
+	SeqData SeqKind = 0x1
+	// SeqAck 确认seq及之前的所有消息, 没有body
+	SeqAck SeqKind = 0x2
+	// SeqResume 客户端重连后请求补发seq之后的消息, 没有body
+	SeqResume SeqKind = 0x3
+)
+
+const seqHeaderSize = 9
+
+// SeqMessage 可靠投递模式下的一条消息
+type SeqMessage struct {
+	Kind SeqKind
+	Seq  uint64
+	Body []byte
+}
+
+// Encode 编码为数据帧的Payload
+func (m SeqMessage) Encode() []byte {
+	p := make([]byte, seqHeaderSize+len(m.Body))
+	p[0] = byte(m.Kind)
+	binary.BigEndian.PutUint64(p[1:], m.Seq)
+	copy(p[seqHeaderSize:], m.Body)
+	return p
+}
+
+// DecodeSeqMessage 解码数据帧的Payload, 返回的Body引用p
+// 格式错误时返回ErrProtocol, 其中包裹的*CloseError为应当回复给对端的关闭码
+func DecodeSeqMessage(p []byte) (SeqMessage, error) {
+	if len(p) < seqHeaderSize {
+		return SeqMessage{}, invalidSeqMessage("short seq message")
+	}
+	m := SeqMessage{
+		Kind: SeqKind(p[0]),
+		Seq:  binary.BigEndian.Uint64(p[1:]),
+	}
+	switch m.Kind {
+	case SeqData:
+		m.Body = p[seqHeaderSize:]
+	case SeqAck, SeqResume:
+		if len(p) > seqHeaderSize {
+			return SeqMessage{}, invalidSeqMessage(fmt.Sprintf("unexpected body in seq kind %#x", byte(m.Kind)))
+		}
+	default:
+		return SeqMessage{}, invalidSeqMessage(fmt.Sprintf("invalid seq kind %#x", byte(m.Kind)))
+	}
+	return m, nil
+}
+
+func invalidSeqMessage(reason string) error {
+	return WrapError(ErrProtocol, &CloseError{Code: CloseInvalidFramePayloadData, Reason: reason})
+}
@@ -0,0 +1,54 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeqMessage(t *testing.T) {
+	tests := map[string]struct {
+		msg SeqMessage
+		raw []byte
+	}{
+		"data": {
+			msg: SeqMessage{Kind: SeqData, Seq: 258, Body: []byte("hi")},
+			raw: []byte{0x1, 0, 0, 0, 0, 0, 0, 0x1, 0x2, 'h', 'i'},
+		},
+		"empty data": {
+			msg: SeqMessage{Kind: SeqData, Body: []byte{}},
+			raw: []byte{0x1, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		"ack": {
+			msg: SeqMessage{Kind: SeqAck, Seq: 1},
+			raw: []byte{0x2, 0, 0, 0, 0, 0, 0, 0, 0x1},
+		},
+		"resume": {
+			msg: SeqMessage{Kind: SeqResume, Seq: 7},
+			raw: []byte{0x3, 0, 0, 0, 0, 0, 0, 0, 0x7},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.raw, tt.msg.Encode())
+			m, err := DecodeSeqMessage(tt.raw)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.msg, m)
+		})
+	}
+}
+
+func TestDecodeSeqMessage_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"short":         {0x1, 0, 0},
+		"invalid kind":  {0x9, 0, 0, 0, 0, 0, 0, 0, 0},
+		"ack with body": {0x2, 0, 0, 0, 0, 0, 0, 0, 0x1, 'x'},
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := DecodeSeqMessage(raw)
+			assert.ErrorIs(t, err, ErrProtocol)
+			assert.True(t, IsCloseError(err, CloseInvalidFramePayloadData))
+		})
+	}
+}
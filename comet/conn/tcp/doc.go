@@ -0,0 +1,21 @@
+// Package tcp 基于TCP的Conn实现
+//
+// 帧格式(与语言无关, 所有整数均为大端序):
+//
+//	 0        1        2                                   6
+//	+--------+--------+--------+--------+--------+--------+---------------+
+//	| opcode | flags  |          payload length           |    payload    |
+//	| 1 byte | 1 byte |              uint32               | length bytes  |
+//	+--------+--------+--------+--------+--------+--------+---------------+
+//
+// opcode: 与WebSocket一致, 见conn.OpCode
+//
+//	0x0 continuation, 0x1 text, 0x2 binary, 0x8 close, 0x9 ping, 0xa pong
+//
+// flags: 最低位(0x01)为MORE, 置1表示后续还有分片(对应WebSocket的FIN=0), 见conn.Frame.More
+// 其余为保留位, 发送方必须置0, 接收方收到非0值视为协议错误
+//
+// payload length: payload的字节数, 可以为0
+//
+// close帧的payload与RFC 6455一致: 2字节关闭码 + UTF-8编码的原因
+package tcp
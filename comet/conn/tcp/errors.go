@@ -0,0 +1,9 @@
+package tcp
+
+import (
+	"github.com/longyue0521/Tim/comet/conn"
+)
+
+// ErrInvalidArgument 参数错误, 与conn.ErrInvalid相同, 保留以兼容已有的调用方
+// conn中不使用同名变量, 否则与本包对conn的点导入冲突
+var ErrInvalidArgument = conn.ErrInvalid
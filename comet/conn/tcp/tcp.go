@@ -1,124 +1,247 @@
 package tcp
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/gob"
+	"fmt"
+	"io"
+	"math"
 	"net"
+	"time"
 
 	. "github.com/longyue0521/Tim/comet/conn"
 	"github.com/pkg/errors"
 )
 
 var (
-	_                  Conn = &tcpServerConn{}
-	_                  Conn = &tcpClientConn{}
-	ErrInvalidArgument      = errors.New("invalid argument")
+	_ HandshakeConn = &tcpServerConn{}
+	_ HandshakeConn = &tcpClientConn{}
 )
 
-func NewServerConn(conn net.Conn) (Conn, error) {
+const (
+	// headerSize 帧头长度: opcode(1) + flags(1) + length(4)
+	headerSize = 6
+	// flagMore 后续还有分片
+	flagMore = 0x01
+
+	DefaultReadBufferSize  = 4096
+	DefaultWriteBufferSize = 4096
+)
+
+// Upgrader 将服务端Accept得到的net.Conn包装为Conn, 零值可用
+// Upgrader{...}.Upgrade可直接作为comet.Upgrader使用
+type Upgrader struct {
+	// ReadBufferSize 读缓冲区大小, 默认DefaultReadBufferSize
+	ReadBufferSize int
+	// WriteBufferSize 写缓冲区大小, 默认DefaultWriteBufferSize
+	// WriteFrame只写入缓冲区, 缓冲区满或调用Flush时才写入socket
+	WriteBufferSize int
+	// MaxFrameSize 单帧Payload上限, 默认conn.DefaultMaxFrameSize
+	// 超过上限时ReadFrame返回ErrFrameTooLarge, 且不会为其分配内存
+	MaxFrameSize int
+	// TLSConfig 非nil时先完成TLS握手, 需要校验客户端证书(mTLS)时设置ClientAuth与ClientCAs
+	TLSConfig *tls.Config
+}
+
+func (u Upgrader) Upgrade(conn net.Conn) (Conn, error) {
 	if conn == nil {
-		return nil, errors.Wrapf(ErrInvalidArgument, "%s conn net.Conn", ErrInvalidArgument)
+		return nil, errors.Wrap(ErrInvalidArgument, "nil net.Conn")
+	}
+	if u.TLSConfig != nil {
+		tc, err := ServerTLS(conn, u.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn = tc
 	}
 	return &tcpServerConn{
-		Conn:    conn,
-		encoder: gob.NewEncoder(conn),
-		decoder: gob.NewDecoder(conn),
-		endian:  binary.BigEndian,
+		Conn:         conn,
+		r:            bufio.NewReaderSize(conn, nonZero(u.ReadBufferSize, DefaultReadBufferSize)),
+		w:            bufio.NewWriterSize(conn, nonZero(u.WriteBufferSize, DefaultWriteBufferSize)),
+		maxFrameSize: nonZero(u.MaxFrameSize, DefaultMaxFrameSize),
+		handshake:    Handshake{TLS: TLSState(conn)},
 	}, nil
 }
 
+// NewServerConn 等价于Upgrader{}.Upgrade(conn)
+func NewServerConn(conn net.Conn) (Conn, error) {
+	return Upgrader{}.Upgrade(conn)
+}
+
 type tcpServerConn struct {
 	net.Conn
-	encoder *gob.Encoder
-	decoder *gob.Decoder
-	endian  binary.ByteOrder
+	r            *bufio.Reader
+	w            *bufio.Writer
+	maxFrameSize int
+	handshake    Handshake
+}
+
+func (t *tcpServerConn) Handshake() Handshake {
+	return t.handshake
 }
 
 func (t *tcpServerConn) ReadFrame() (Frame, error) {
-	f := tcpFrameUnmarshaler{Frame{}, t.endian}
-	if err := t.decoder.Decode(&f); err != nil {
-		return Frame{}, err
+	f, err := readFrame(t.r, t.maxFrameSize)
+	if err != nil {
+		return Frame{}, WrapReadError(err)
 	}
-	return f.Frame, nil
+	return f, nil
 }
 
+// WriteFrame 写入缓冲区, 需调用Flush确保发送
 func (t *tcpServerConn) WriteFrame(f Frame) error {
-	frame := f
-	fm := tcpFrameMarshaler{frame, t.endian}
-	return t.encoder.Encode(&fm)
+	return WrapWriteError(writeFrame(t.w, f))
 }
 
 func (t *tcpServerConn) Flush() error {
-	return nil
-}
-
-type tcpFrameMarshaler struct {
-	Frame
-	endian binary.ByteOrder
+	return WrapWriteError(t.w.Flush())
 }
 
-func (f *tcpFrameMarshaler) MarshalBinary() (data []byte, err error) {
-	// data = byte[]{byte(OpCode), int32(len(payload)), payload}
-	buf := new(bytes.Buffer)
-
-	if err := binary.Write(buf, f.endian, byte(f.Opcode)); err != nil {
-		return nil, err
+// readFrame 按帧格式从r读取一帧, payload超过maxSize时返回ErrFrameTooLarge
+func readFrame(r io.Reader, maxSize int) (Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
 	}
 
-	if err := binary.Write(buf, f.endian, int32(len(f.Payload))); err != nil {
-		return nil, err
+	op, flags := OpCode(header[0]), header[1]
+	if !IsValidOpCode(op) {
+		return Frame{}, WrapError(ErrProtocol, &CloseError{
+			Code:   CloseProtocolError,
+			Reason: fmt.Sprintf("invalid opcode %#x", byte(op)),
+		})
+	}
+	if flags&^flagMore != 0 {
+		return Frame{}, WrapError(ErrProtocol, &CloseError{
+			Code:   CloseProtocolError,
+			Reason: fmt.Sprintf("non-zero reserved flags %#x", flags),
+		})
 	}
+	more := flags&flagMore != 0
 
-	if err := binary.Write(buf, f.endian, f.Payload); err != nil {
-		return nil, err
+	length := binary.BigEndian.Uint32(header[2:])
+	if length == 0 {
+		return Frame{Opcode: op, More: more}, nil
+	}
+	if uint64(length) > uint64(maxSize) {
+		return Frame{}, NewFrameTooLargeError(uint64(length), maxSize)
 	}
 
-	return buf.Bytes(), nil
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, err
+	}
+	return Frame{Opcode: op, More: more, Payload: payload}, nil
 }
 
-type tcpFrameUnmarshaler struct {
-	Frame
-	endian binary.ByteOrder
-}
+// writeFrame 按帧格式将f写入w
+func writeFrame(w io.Writer, f Frame) error {
+	if !IsValidOpCode(f.Opcode) {
+		return errors.Wrapf(ErrInvalidOpCode, "%#x", byte(f.Opcode))
+	}
+	if uint64(len(f.Payload)) > math.MaxUint32 {
+		return errors.Wrapf(ErrFrameTooLarge, "payload length %d", len(f.Payload))
+	}
 
-func (f *tcpFrameUnmarshaler) UnmarshalBinary(data []byte) error {
-	// data = byte[]{byte(OpCode), int32(len(payload)), payload}
-	r := bytes.NewReader(data)
-	if err := binary.Read(r, f.endian, &f.Opcode); err != nil {
-		return err
+	var header [headerSize]byte
+	header[0] = byte(f.Opcode)
+	if f.More {
+		header[1] = flagMore
 	}
+	binary.BigEndian.PutUint32(header[2:], uint32(len(f.Payload)))
 
-	var length int32
-	if err := binary.Read(r, f.endian, &length); err != nil {
+	if _, err := w.Write(header[:]); err != nil {
 		return err
 	}
-	if length <= 0 {
-		return nil
-	}
+	_, err := w.Write(f.Payload)
+	return err
+}
 
-	payload := make([]byte, length)
-	if err := binary.Read(r, f.endian, payload); err != nil {
-		return err
+func nonZero(a, b int) int {
+	if a > 0 {
+		return a
 	}
-	f.Payload = payload
+	return b
+}
 
-	return nil
+// Dialer 连接服务端并包装为Conn, 零值可用
+type Dialer struct {
+	// ReadBufferSize 读缓冲区大小, 默认DefaultReadBufferSize
+	ReadBufferSize int
+	// WriteBufferSize 写缓冲区大小, 默认DefaultWriteBufferSize
+	WriteBufferSize int
+	// MaxFrameSize 单帧Payload上限, 默认conn.DefaultMaxFrameSize
+	MaxFrameSize int
+	// TLSConfig 非nil时使用TLS, 未设置ServerName时使用address中的主机名校验服务端证书
+	// mTLS时在Certificates中设置客户端证书
+	TLSConfig *tls.Config
+	// Timeout 建立TCP连接(包括通过代理建立隧道)的超时, 0表示只受ctx限制
+	Timeout time.Duration
+	// HandshakeTimeout TLS握手的超时, 0表示只受ctx限制
+	HandshakeTimeout time.Duration
+	// LocalAddr 绑定的本地地址, nil时由系统选择
+	LocalAddr net.Addr
+	// Proxy 非nil时通过其返回的代理连接
+	Proxy ProxyFunc
 }
 
-func NewClientConn(address string) (Conn, error) {
-	conn, err := net.Dial("tcp", address)
+// Dial 等价于DialContext(context.Background(), address)
+func (d Dialer) Dial(address string) (Conn, error) {
+	return d.DialContext(context.Background(), address)
+}
+
+// DialContext 连接address, ctx结束时中断连接与握手
+func (d Dialer) DialContext(ctx context.Context, address string) (Conn, error) {
+	conn, err := d.dial(ctx, address)
 	if err != nil {
-		// TODO: rewrite error
-		return nil, err
+		return nil, WrapError(ErrDialFailed, err)
+	}
+	if d.TLSConfig != nil {
+		hctx, cancel := withTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+		host, _, _ := net.SplitHostPort(address)
+		tc, err := ClientTLS(hctx, conn, host, d.TLSConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
 	}
-	server, err := NewServerConn(conn)
+	server, err := Upgrader{
+		ReadBufferSize:  d.ReadBufferSize,
+		WriteBufferSize: d.WriteBufferSize,
+		MaxFrameSize:    d.MaxFrameSize,
+	}.Upgrade(conn)
 	if err != nil {
 		return nil, err
 	}
 	return &tcpClientConn{server}, nil
 }
 
+func (d Dialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, d.Timeout)
+	defer cancel()
+	return DialTCP(ctx, &net.Dialer{LocalAddr: d.LocalAddr}, d.Proxy, address)
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// NewClientConn 等价于Dialer{}.Dial(address)
+func NewClientConn(address string) (Conn, error) {
+	return Dialer{}.Dial(address)
+}
+
 type tcpClientConn struct {
 	Conn
 }
+
+func (t *tcpClientConn) Handshake() Handshake {
+	return HandshakeOf(t.Conn)
+}
@@ -1,24 +1,27 @@
 package tcp
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/internal/testcert"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewServerConn_NewClientConn(t *testing.T) {
 	server, err := NewServerConn(nil)
 	assert.Nil(t, server)
-	fmt.Println(err)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
 
 	client, err := NewClientConn("")
 	assert.Nil(t, client)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrDialFailed)
 }
 
 func TestTCPsocket(t *testing.T) {
@@ -45,6 +48,7 @@ func TestTCPsocket(t *testing.T) {
 			err := client.WriteFrame(frame)
 			assert.NoError(t, err)
 		}
+		assert.NoError(t, client.Flush())
 		// 连续读
 		for _, frame := range frames {
 			f, err := client.ReadFrame()
@@ -74,6 +78,7 @@ func TestTCPsocket(t *testing.T) {
 		// 回写
 		err = server.WriteFrame(f)
 		assert.NoError(t, err)
+		assert.NoError(t, server.Flush())
 	}
 
 	assert.NoError(t, server.Close())
@@ -103,6 +108,7 @@ func TestServerConnReadFrame_ClientConnWriteFrame(t *testing.T) {
 			err := client.WriteFrame(frame)
 			assert.NoError(t, err)
 		}
+		assert.NoError(t, client.Flush())
 
 		err = client.Close()
 		assert.NoError(t, err)
@@ -128,6 +134,7 @@ func TestServerConnReadFrame_ClientConnWriteFrame(t *testing.T) {
 	f, err := server.ReadFrame()
 	assert.Equal(t, Frame{}, f)
 	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, err, ErrRemoteClosed)
 
 	assert.NoError(t, server.Close())
 }
@@ -180,6 +187,289 @@ func TestServerConnWriteFrame_ClientConnReadFrame(t *testing.T) {
 		err = server.WriteFrame(frame)
 		assert.NoError(t, err)
 	}
+	assert.NoError(t, server.Flush())
 
 	assert.NoError(t, server.Close())
 }
+
+func TestWireFormat(t *testing.T) {
+	tests := map[string]struct {
+		frame Frame
+		raw   []byte
+	}{
+		"binary": {
+			frame: Frame{Opcode: OpBinary, Payload: []byte("abc")},
+			raw:   []byte{0x2, 0x0, 0x0, 0x0, 0x0, 0x3, 'a', 'b', 'c'},
+		},
+		"empty ping": {
+			frame: Frame{Opcode: OpPing},
+			raw:   []byte{0x9, 0x0, 0x0, 0x0, 0x0, 0x0},
+		},
+		"close": {
+			frame: NewCloseFrame(CloseNormalClosure, "ok"),
+			raw:   []byte{0x8, 0x0, 0x0, 0x0, 0x0, 0x4, 0x03, 0xe8, 'o', 'k'},
+		},
+		"first fragment": {
+			frame: Frame{Opcode: OpText, More: true, Payload: []byte("ab")},
+			raw:   []byte{0x1, 0x1, 0x0, 0x0, 0x0, 0x2, 'a', 'b'},
+		},
+		"last fragment": {
+			frame: Frame{Opcode: OpContinuation, Payload: []byte("c")},
+			raw:   []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 'c'},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			assert.NoError(t, writeFrame(buf, tt.frame))
+			assert.Equal(t, tt.raw, buf.Bytes())
+
+			f, err := readFrame(bytes.NewReader(tt.raw), DefaultMaxFrameSize)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.frame, f)
+		})
+	}
+}
+
+func TestReadFrame_Invalid(t *testing.T) {
+	tests := map[string]struct {
+		raw     []byte
+		wantErr error
+	}{
+		"reserved opcode":     {[]byte{0x3, 0x0, 0x0, 0x0, 0x0, 0x0}, ErrProtocol},
+		"non-zero flags":      {[]byte{0x2, 0x80, 0x0, 0x0, 0x0, 0x0}, ErrProtocol},
+		"short header":        {[]byte{0x2, 0x0, 0x0}, io.ErrUnexpectedEOF},
+		"short payload":       {[]byte{0x2, 0x0, 0x0, 0x0, 0x0, 0x3, 'a'}, io.ErrUnexpectedEOF},
+		"empty stream is eof": {[]byte{}, io.EOF},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := readFrame(bytes.NewReader(tt.raw), DefaultMaxFrameSize)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	assert.ErrorIs(t, writeFrame(new(bytes.Buffer), Frame{Opcode: OpCode(0x3)}), ErrInvalidOpCode)
+}
+
+// TestServerConn_RawClient 模拟非Go客户端直接按帧格式读写socket
+func TestServerConn_RawClient(t *testing.T) {
+	s, c := net.Pipe()
+	server, err := NewServerConn(s)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	go func() {
+		_, _ = c.Write([]byte{0x1, 0x0, 0x0, 0x0, 0x0, 0x2, 'h', 'i'})
+	}()
+	f, err := server.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{Opcode: OpText, Payload: []byte("hi")}, f)
+
+	go func() {
+		assert.NoError(t, server.WriteFrame(Frame{Opcode: OpPong}))
+		assert.NoError(t, server.Flush())
+	}()
+	raw := make([]byte, headerSize)
+	_, err = io.ReadFull(c, raw)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xa, 0x0, 0x0, 0x0, 0x0, 0x0}, raw)
+	assert.NoError(t, c.Close())
+}
+
+// countConn 统计底层socket的Write次数
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+func TestServerConn_Flush(t *testing.T) {
+	s, _ := net.Pipe()
+	raw := &countConn{Conn: s}
+
+	tests := map[string]struct {
+		upgrader   Upgrader
+		frames     int
+		wantWrites int
+	}{
+		"coalesce into one write": {Upgrader{}, 10, 1},
+		"small write buffer":      {Upgrader{WriteBufferSize: 16}, 4, 4},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			raw.writes = 0
+			server, err := tt.upgrader.Upgrade(raw)
+			assert.NoError(t, err)
+
+			for i := 0; i < tt.frames; i++ {
+				assert.NoError(t, server.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("payload")}))
+			}
+			assert.NoError(t, server.Flush())
+			assert.Equal(t, tt.wantWrites, raw.writes)
+		})
+	}
+}
+
+func TestServerConn_MaxFrameSize(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+	server, err := Upgrader{MaxFrameSize: 8}.Upgrade(s)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	go func() {
+		// 声明长度为2GB的帧, 服务端不应为其分配内存
+		_, _ = c.Write([]byte{0x2, 0x0, 0x7f, 0xff, 0xff, 0xff})
+	}()
+
+	f, err := server.ReadFrame()
+	assert.Equal(t, Frame{}, f)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.True(t, IsCloseError(err, CloseMessageTooBig))
+}
+
+func TestTLS(t *testing.T) {
+	certs, err := testcert.New()
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		server        *tls.Config
+		client        *tls.Config
+		wantServerErr bool
+		wantClientErr bool
+	}{
+		"tls":                 {server: certs.ServerConfig(false), client: certs.ClientConfig(false)},
+		"mtls":                {server: certs.ServerConfig(true), client: certs.ClientConfig(true)},
+		"mtls without cert":   {server: certs.ServerConfig(true), client: certs.ClientConfig(false), wantServerErr: true},
+		"untrusted server ca": {server: certs.ServerConfig(false), client: &tls.Config{}, wantServerErr: true, wantClientErr: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:")
+			assert.NoError(t, err)
+			defer ln.Close()
+
+			clientErr := make(chan error, 1)
+			go func() {
+				client, err := Dialer{TLSConfig: tt.client}.Dial(ln.Addr().String())
+				clientErr <- err
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				if err := client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}); err == nil {
+					_ = client.Flush()
+				}
+				_, _ = client.ReadFrame()
+			}()
+
+			conn, err := ln.Accept()
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			server, err := Upgrader{TLSConfig: tt.server}.Upgrade(conn)
+			if tt.wantServerErr {
+				assert.ErrorIs(t, err, ErrHandshakeFailed)
+				conn.Close()
+			} else {
+				assert.NoError(t, err)
+				f, err := server.ReadFrame()
+				assert.NoError(t, err)
+				assert.Equal(t, Frame{Opcode: OpBinary, Payload: []byte("hello")}, f)
+
+				hs := HandshakeOf(server)
+				assert.NotNil(t, hs.TLS)
+				assert.Equal(t, tt.server.ClientAuth == tls.RequireAndVerifyClientCert, len(hs.TLS.PeerCertificates) > 0)
+				server.Close()
+			}
+
+			err = <-clientErr
+			if tt.wantClientErr {
+				assert.ErrorIs(t, err, ErrHandshakeFailed)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDialer_DialContext(t *testing.T) {
+	// 接受连接但不进行TLS握手
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := map[string]struct {
+		// ctxTimeout <0 表示使用已取消的ctx
+		ctxTimeout time.Duration
+		dialer     Dialer
+		wantErr    error
+		wantTime   bool
+	}{
+		"canceled": {
+			ctxTimeout: -1,
+			wantErr:    ErrDialFailed,
+		},
+		"handshake timeout": {
+			dialer:   Dialer{TLSConfig: &tls.Config{}, HandshakeTimeout: 50 * time.Millisecond},
+			wantErr:  ErrHandshakeFailed,
+			wantTime: true,
+		},
+		"ctx deadline during handshake": {
+			ctxTimeout: 50 * time.Millisecond,
+			dialer:     Dialer{TLSConfig: &tls.Config{}},
+			wantErr:    ErrHandshakeFailed,
+			wantTime:   true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.ctxTimeout > 0 {
+				ctx, cancel = context.WithTimeout(context.Background(), tt.ctxTimeout)
+			}
+			defer cancel()
+			if tt.ctxTimeout < 0 {
+				cancel()
+			}
+
+			start := time.Now()
+			client, err := tt.dialer.DialContext(ctx, ln.Addr().String())
+			assert.Nil(t, client)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantTime, IsTimeout(err))
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		})
+	}
+}
+
+func TestDialer_LocalAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	client, err := Dialer{LocalAddr: local, Timeout: time.Second}.Dial(ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, local.IP.Equal(client.LocalAddr().(*net.TCPAddr).IP))
+
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.Close()
+}
@@ -0,0 +1,49 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ServerTLS 在conn上完成TLS服务端握手, 失败时返回ErrHandshakeFailed
+// 握手超时由调用方通过conn的Deadline控制
+func ServerTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tc := tls.Server(conn, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, WrapError(ErrHandshakeFailed, err)
+	}
+	return tc, nil
+}
+
+// ClientTLS 在conn上完成TLS客户端握手, config未设置ServerName时使用hostname校验证书
+// ctx结束时中断握手, 失败时返回ErrHandshakeFailed
+func ClientTLS(ctx context.Context, conn net.Conn, hostname string, config *tls.Config) (*tls.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = hostname
+	}
+	tc := tls.Client(conn, config)
+	stop := interruptOnDone(ctx, conn)
+	err := tc.Handshake()
+	if serr := stop(); serr != nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, WrapError(ErrHandshakeFailed, err)
+	}
+	return tc, nil
+}
+
+// TLSState 返回conn的TLS连接状态, 非TLS连接返回nil
+func TLSState(conn net.Conn) *tls.ConnectionState {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
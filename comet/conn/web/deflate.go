@@ -0,0 +1,200 @@
+package web
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/pkg/errors"
+)
+
+// DefaultCompressionThreshold 小于该大小的消息不压缩, 压缩小消息得不偿失
+const DefaultCompressionThreshold = 256
+
+// flateTail 同步刷新块的结尾(发送方去掉, 接收方补上)加一个空的结束块, 使解压器得到io.EOF
+var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compression permessage-deflate压缩配置(RFC 7692), 服务端与客户端都配置时才会启用
+type Compression struct {
+	// ServerNoContextTakeover 服务端每条消息重置压缩上下文, 节省内存但压缩率下降
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover 客户端每条消息重置压缩上下文, 节省内存但压缩率下降
+	ClientNoContextTakeover bool
+	// Level 压缩级别, 见compress/flate, 0表示flate.DefaultCompression
+	Level int
+	// Threshold 小于该大小的消息不压缩, 默认DefaultCompressionThreshold
+	Threshold int
+}
+
+func (c *Compression) parameters() wsflate.Parameters {
+	return wsflate.Parameters{
+		ServerNoContextTakeover: c.ServerNoContextTakeover,
+		ClientNoContextTakeover: c.ClientNoContextTakeover,
+	}
+}
+
+// serverFlate 根据服务端协商结果创建messageFlate, 未协商成功时返回nil
+func (c *Compression) serverFlate(ext *wsflate.Extension) *messageFlate {
+	if c == nil {
+		return nil
+	}
+	offer, accepted := ext.Accepted()
+	if !accepted {
+		return nil
+	}
+	return c.newFlate(c.ServerNoContextTakeover, c.ClientNoContextTakeover || offer.ClientNoContextTakeover)
+}
+
+// clientFlate 根据服务端的握手响应创建messageFlate, 服务端未接受时返回nil
+func (c *Compression) clientFlate(extensions []httphead.Option) (*messageFlate, error) {
+	if c == nil {
+		return nil, nil
+	}
+	for _, opt := range extensions {
+		if !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+			continue
+		}
+		var p wsflate.Parameters
+		if err := p.Parse(opt); err != nil {
+			return nil, err
+		}
+		// flate的窗口固定为32KB, 无法满足更小的client_max_window_bits
+		if p.ClientMaxWindowBits.Defined() && p.ClientMaxWindowBits.Bytes() < wsflate.MaxLZ77WindowSize {
+			return nil, errors.Errorf("unsupported client_max_window_bits %d", p.ClientMaxWindowBits)
+		}
+		return c.newFlate(c.ClientNoContextTakeover || p.ClientNoContextTakeover, p.ServerNoContextTakeover), nil
+	}
+	return nil, nil
+}
+
+func (c *Compression) newFlate(writeNoContextTakeover, readNoContextTakeover bool) *messageFlate {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &messageFlate{
+		level:                  level,
+		threshold:              nonZero(c.Threshold, DefaultCompressionThreshold),
+		writeNoContextTakeover: writeNoContextTakeover,
+		readNoContextTakeover:  readNoContextTakeover,
+	}
+}
+
+// messageFlate 一条连接上的压缩状态, 读写分别只在一个协程中使用
+// 压缩以消息为单位: 分片发送的消息不压缩, 收到的压缩分片在这里合并后解压
+type messageFlate struct {
+	level                  int
+	threshold              int
+	writeNoContextTakeover bool
+	readNoContextTakeover  bool
+
+	fw   *flate.Writer
+	wbuf bytes.Buffer
+
+	// dict 上下文接管时保存最近32KB的解压结果, 作为下一条消息的字典
+	dict []byte
+
+	// 正在合并的压缩消息
+	op      ws.OpCode
+	frag    []byte
+	pending bool
+}
+
+// newFrame 将f转换为待发送的ws.Frame, 满足条件时压缩并设置RSV1
+func (m *messageFlate) newFrame(f Frame) (ws.Frame, error) {
+	op := ws.OpCode(f.Opcode)
+	if m == nil || !op.IsData() || op == ws.OpContinuation || f.More || len(f.Payload) < m.threshold {
+		return ws.NewFrame(op, !f.More, f.Payload), nil
+	}
+	payload, err := m.compress(f.Payload)
+	if err != nil {
+		return ws.Frame{}, err
+	}
+	frame := ws.NewFrame(op, true, payload)
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	return frame, nil
+}
+
+// compress 返回的切片在下一次调用前有效
+func (m *messageFlate) compress(p []byte) ([]byte, error) {
+	m.wbuf.Reset()
+	switch {
+	case m.fw == nil:
+		fw, err := flate.NewWriter(&m.wbuf, m.level)
+		if err != nil {
+			return nil, err
+		}
+		m.fw = fw
+	case m.writeNoContextTakeover:
+		m.fw.Reset(&m.wbuf)
+	}
+	if _, err := m.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := m.fw.Flush(); err != nil {
+		return nil, err
+	}
+	// Flush以0x00 0x00 0xff 0xff结尾, RFC 7692要求去掉
+	return m.wbuf.Bytes()[:m.wbuf.Len()-4], nil
+}
+
+// readFrame 处理收到的帧, 压缩消息的中间分片返回ok=false
+func (m *messageFlate) readFrame(f ws.Frame, maxSize int) (_ Frame, ok bool, err error) {
+	h, compressed, err := wsflate.UnsetBit(f.Header)
+	if err != nil {
+		return Frame{}, false, err
+	}
+
+	switch {
+	case !h.OpCode.IsData():
+	case m.pending:
+		if h.OpCode != ws.OpContinuation {
+			return Frame{}, false, ws.ErrProtocolContinuationExpected
+		}
+		if len(m.frag)+len(f.Payload) > maxSize {
+			return Frame{}, false, NewFrameTooLargeError(uint64(len(m.frag)+len(f.Payload)), maxSize)
+		}
+		m.frag = append(m.frag, f.Payload...)
+		if !h.Fin {
+			return Frame{}, false, nil
+		}
+		m.pending = false
+		payload, err := m.decompress(m.frag, maxSize)
+		m.frag = m.frag[:0]
+		return Frame{Opcode: OpCode(m.op), Payload: payload}, true, err
+	case compressed && !h.Fin:
+		m.op, m.frag, m.pending = h.OpCode, append(m.frag[:0], f.Payload...), true
+		return Frame{}, false, nil
+	case compressed:
+		payload, err := m.decompress(f.Payload, maxSize)
+		return Frame{Opcode: OpCode(h.OpCode), Payload: payload}, true, err
+	}
+	return Frame{Opcode: OpCode(h.OpCode), More: !h.Fin, Payload: f.Payload}, true, nil
+}
+
+// decompress 解压后的消息视为一帧, 同样受maxSize限制
+func (m *messageFlate) decompress(p []byte, maxSize int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(flateTail))
+	fr := flate.NewReaderDict(src, m.dict)
+	defer fr.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(fr, int64(maxSize)+1))
+	if err != nil {
+		return nil, WrapError(ErrProtocol, &CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid deflate data"})
+	}
+	if len(payload) > maxSize {
+		return nil, NewFrameTooLargeError(uint64(len(payload)), maxSize)
+	}
+
+	if !m.readNoContextTakeover {
+		m.dict = append(m.dict, payload...)
+		if n := len(m.dict) - wsflate.MaxLZ77WindowSize; n > 0 {
+			m.dict = append(m.dict[:0], m.dict[n:]...)
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageFlate(t *testing.T) {
+	tests := map[string]struct {
+		noContextTakeover bool
+	}{
+		"context takeover":    {false},
+		"no context takeover": {true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &Compression{Threshold: 8}
+			w := c.newFlate(tt.noContextTakeover, false)
+			r := c.newFlate(false, tt.noContextTakeover)
+
+			msg := bytes.Repeat([]byte(`{"type":"chat","body":"hello"}`), 10)
+			var sizes []int
+			for i := 0; i < 3; i++ {
+				frame, err := w.newFrame(Frame{Opcode: OpText, Payload: msg})
+				assert.NoError(t, err)
+				compressed, err := wsflate.IsCompressed(frame.Header)
+				assert.NoError(t, err)
+				assert.True(t, compressed)
+				assert.Less(t, len(frame.Payload), len(msg))
+				sizes = append(sizes, len(frame.Payload))
+
+				f, ok, err := r.readFrame(frame, DefaultMaxFrameSize)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+				assert.Equal(t, Frame{Opcode: OpText, Payload: msg}, f)
+			}
+			// 上下文接管时后续相同的消息可以引用上一条消息
+			if tt.noContextTakeover {
+				assert.Equal(t, sizes[0], sizes[1])
+			} else {
+				assert.Less(t, sizes[1], sizes[0])
+			}
+		})
+	}
+}
+
+func TestMessageFlate_Uncompressed(t *testing.T) {
+	m := (&Compression{Threshold: 8}).newFlate(false, false)
+
+	tests := map[string]Frame{
+		"below threshold": {Opcode: OpBinary, Payload: []byte("short")},
+		"control frame":   {Opcode: OpPing, Payload: []byte("ping payload")},
+		"fragment":        {Opcode: OpBinary, More: true, Payload: []byte("fragmented payload")},
+	}
+	for name, f := range tests {
+		t.Run(name, func(t *testing.T) {
+			frame, err := m.newFrame(f)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(0), frame.Header.Rsv)
+			assert.Equal(t, f.Payload, frame.Payload)
+
+			got, ok, err := m.readFrame(frame, DefaultMaxFrameSize)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, f, got)
+		})
+	}
+}
+
+func TestMessageFlate_ReadFragmented(t *testing.T) {
+	w := (&Compression{}).newFlate(false, false)
+	msg := bytes.Repeat([]byte("abcdefgh"), 100)
+	payload, err := w.compress(msg)
+	assert.NoError(t, err)
+
+	first := ws.NewFrame(ws.OpBinary, false, payload[:len(payload)/2])
+	first.Header.Rsv = ws.Rsv(true, false, false)
+	last := ws.NewFrame(ws.OpContinuation, true, payload[len(payload)/2:])
+
+	r := (&Compression{}).newFlate(false, false)
+	_, ok, err := r.readFrame(first, DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// 分片之间的控制帧直接返回
+	f, ok, err := r.readFrame(ws.NewPingFrame(nil), DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Frame{Opcode: OpPing}, f)
+
+	f, ok, err = r.readFrame(last, DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Frame{Opcode: OpBinary, Payload: msg}, f)
+}
+
+func TestMessageFlate_ReadInvalid(t *testing.T) {
+	w := (&Compression{}).newFlate(false, false)
+	bomb, err := w.compress(make([]byte, 1<<16))
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		frame   ws.Frame
+		wantErr error
+	}{
+		"decompressed too large": {
+			frame:   ws.NewBinaryFrame(bomb),
+			wantErr: ErrFrameTooLarge,
+		},
+		"invalid deflate data": {
+			frame:   ws.NewBinaryFrame([]byte{0xff, 0xff, 0xff}),
+			wantErr: ErrProtocol,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tt.frame.Header.Rsv = ws.Rsv(true, false, false)
+			r := (&Compression{}).newFlate(false, false)
+			_, _, err := r.readFrame(tt.frame, 1024)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	// 控制帧不能设置RSV1
+	ping := ws.NewPingFrame(nil)
+	ping.Header.Rsv = ws.Rsv(true, false, false)
+	_, _, err = w.readFrame(ping, DefaultMaxFrameSize)
+	assert.ErrorIs(t, err, wsflate.ErrUnexpectedCompressionBit)
+}
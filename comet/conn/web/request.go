@@ -0,0 +1,118 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gobwas/ws"
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// RejectError 拒绝握手, 在Upgrader.OnRequest中返回以指定HTTP响应状态码
+type RejectError struct {
+	Status int
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("web: handshake rejected %d (%s)", e.Status, e.Reason)
+}
+
+// Reject 返回拒绝握手的错误, status为HTTP响应状态码
+func Reject(status int, reason string) error {
+	return &RejectError{Status: status, Reason: reason}
+}
+
+// checkRequest 执行CheckOrigin与OnRequest, 拒绝时返回*RejectError
+func (u *Upgrader) checkRequest(r *http.Request) (Metadata, error) {
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		return nil, &RejectError{Status: http.StatusForbidden, Reason: "origin not allowed"}
+	}
+	if u.OnRequest == nil {
+		return nil, nil
+	}
+	md, err := u.OnRequest(r)
+	if err != nil {
+		if rej, ok := err.(*RejectError); ok {
+			return nil, rej
+		}
+		return nil, &RejectError{Status: http.StatusForbidden, Reason: err.Error()}
+	}
+	return md, nil
+}
+
+func (u *Upgrader) selectProtocol(p string) bool {
+	for _, protocol := range u.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHooks 通过ws.Upgrader的回调收集握手请求, 在升级前执行Upgrader中的校验
+type requestHooks struct {
+	u        *Upgrader
+	conn     net.Conn
+	uri      string
+	host     string
+	header   http.Header
+	metadata Metadata
+}
+
+func (h *requestHooks) install(upgrader *ws.Upgrader) {
+	if len(h.u.Protocols) > 0 {
+		upgrader.Protocol = func(p []byte) bool {
+			return h.u.selectProtocol(string(p))
+		}
+	}
+	if h.u.CheckOrigin == nil && h.u.OnRequest == nil {
+		return
+	}
+	h.header = make(http.Header)
+	upgrader.OnRequest = func(uri []byte) error {
+		h.uri = string(uri)
+		return nil
+	}
+	upgrader.OnHost = func(host []byte) error {
+		h.host = string(host)
+		return nil
+	}
+	upgrader.OnHeader = func(key, value []byte) error {
+		h.header.Add(string(key), string(value))
+		return nil
+	}
+	upgrader.OnBeforeUpgrade = h.beforeUpgrade
+}
+
+func (h *requestHooks) beforeUpgrade() (ws.HandshakeHeader, error) {
+	u, err := url.ParseRequestURI(h.uri)
+	if err != nil {
+		return nil, rejectConnection(&RejectError{Status: http.StatusBadRequest, Reason: "invalid request uri"})
+	}
+	r := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h.header,
+		Host:       h.host,
+		RequestURI: h.uri,
+		RemoteAddr: h.conn.RemoteAddr().String(),
+	}
+
+	md, err := h.u.checkRequest(r)
+	if err != nil {
+		return nil, rejectConnection(err.(*RejectError))
+	}
+	h.metadata = md
+	return nil, nil
+}
+
+// rejectConnection 转换为ws.Upgrader可识别的错误, 由其写出HTTP响应
+func rejectConnection(rej *RejectError) error {
+	return ws.RejectConnectionError(ws.RejectionStatus(rej.Status), ws.RejectionReason(rej.Reason))
+}
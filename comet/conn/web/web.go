@@ -2,85 +2,397 @@ package web
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"io"
 	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/pkg/errors"
 )
 
 var (
-	_ Conn = &wsServerConn{}
-	_ Conn = &wsClientConn{}
+	_ HandshakeConn = &wsServerConn{}
+	_ HandshakeConn = &wsClientConn{}
 )
 
-func NewServerConn(conn net.Conn) (Conn, error) {
-	wsConn := &wsServerConn{conn}
-	_, err := ws.Upgrade(wsConn.Conn)
+const (
+	DefaultReadBufferSize  = 4096
+	DefaultWriteBufferSize = 4096
+)
+
+// Upgrader 完成WebSocket握手并将服务端net.Conn包装为Conn, 零值可用
+// Upgrader{...}.Upgrade可直接作为comet.Upgrader使用
+type Upgrader struct {
+	// ReadBufferSize 读缓冲区大小, 默认DefaultReadBufferSize
+	ReadBufferSize int
+	// WriteBufferSize 写缓冲区大小, 默认DefaultWriteBufferSize
+	// WriteFrame只写入缓冲区, 缓冲区满或调用Flush时才写入socket
+	WriteBufferSize int
+	// MaxFrameSize 单帧Payload上限, 默认conn.DefaultMaxFrameSize
+	// 超过上限时ReadFrame返回ErrFrameTooLarge, 且不会为其分配内存
+	MaxFrameSize int
+	// Compression 非nil时接受客户端的permessage-deflate请求
+	Compression *Compression
+	// Protocols 支持的子协议, 按客户端请求的顺序选择第一个支持的, 都不支持时不选择
+	Protocols []string
+	// CheckOrigin 校验Origin等请求信息, 返回false时以403拒绝握手, nil时不校验
+	CheckOrigin func(r *http.Request) bool
+	// OnRequest 在握手成功前调用, 可检查路径、头部、查询参数与Cookie并提取鉴权token等数据
+	// 返回的Metadata通过conn.HandshakeOf获取; 返回错误时拒绝握手, 用Reject指定HTTP状态码, 其他错误为403
+	OnRequest func(r *http.Request) (Metadata, error)
+	// TLSConfig 非nil时Upgrade先完成TLS握手(wss), 需要校验客户端证书(mTLS)时设置ClientAuth与ClientCAs
+	// UpgradeHTTP不使用该配置, TLS由http.Server负责
+	TLSConfig *tls.Config
+}
+
+func (u Upgrader) Upgrade(conn net.Conn) (Conn, error) {
+	if conn == nil {
+		return nil, errors.Wrap(ErrInvalid, "nil net.Conn")
+	}
+	if u.TLSConfig != nil {
+		tc, err := ServerTLS(conn, u.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	var (
+		upgrader ws.Upgrader
+		ext      wsflate.Extension
+	)
+	if u.Compression != nil {
+		ext.Parameters = u.Compression.parameters()
+		upgrader.Negotiate = ext.Negotiate
+	}
+	hooks := &requestHooks{u: &u, conn: conn}
+	hooks.install(&upgrader)
+
+	hs, err := upgrader.Upgrade(conn)
 	if err != nil {
-		// TODO: redefine error
-		return nil, err
+		return nil, WrapError(ErrHandshakeFailed, err)
 	}
-	return wsConn, nil
+	return u.newServerConn(conn, nil, &ext, Handshake{Protocol: hs.Protocol, Metadata: hooks.metadata, TLS: TLSState(conn)}), nil
+}
+
+// UpgradeHTTP 在http.Handler中完成握手, 劫持(Hijack)底层连接并包装为Conn
+// 校验失败时写出HTTP错误响应, 成功后w与r不能再使用
+func (u Upgrader) UpgradeHTTP(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	md, err := u.checkRequest(r)
+	if err != nil {
+		rej := err.(*RejectError)
+		http.Error(w, rej.Reason, rej.Status)
+		return nil, WrapError(ErrHandshakeFailed, err)
+	}
+
+	var (
+		upgrader ws.HTTPUpgrader
+		ext      wsflate.Extension
+	)
+	if u.Compression != nil {
+		ext.Parameters = u.Compression.parameters()
+		upgrader.Negotiate = ext.Negotiate
+	}
+	if len(u.Protocols) > 0 {
+		upgrader.Protocol = u.selectProtocol
+	}
+	conn, rw, hs, err := upgrader.Upgrade(r, w)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, WrapError(ErrHandshakeFailed, err)
+	}
+
+	var br *bufio.Reader
+	if rw != nil && rw.Reader.Buffered() > 0 {
+		// 劫持时缓冲区中可能已有客户端紧随握手发送的帧
+		buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+		br = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), conn),
+			nonZero(u.ReadBufferSize, DefaultReadBufferSize))
+	}
+	return u.newServerConn(conn, br, &ext, Handshake{Protocol: hs.Protocol, Metadata: md, TLS: r.TLS}), nil
+}
+
+// newServerConn br为nil时按ReadBufferSize创建
+func (u *Upgrader) newServerConn(conn net.Conn, br *bufio.Reader, ext *wsflate.Extension, hs Handshake) *wsServerConn {
+	if br == nil {
+		br = bufio.NewReaderSize(conn, nonZero(u.ReadBufferSize, DefaultReadBufferSize))
+	}
+	return &wsServerConn{
+		Conn:         conn,
+		r:            br,
+		w:            bufio.NewWriterSize(conn, nonZero(u.WriteBufferSize, DefaultWriteBufferSize)),
+		maxFrameSize: nonZero(u.MaxFrameSize, DefaultMaxFrameSize),
+		flate:        u.Compression.serverFlate(ext),
+		handshake:    hs,
+	}
+}
+
+// NewServerConn 等价于Upgrader{}.Upgrade(conn)
+func NewServerConn(conn net.Conn) (Conn, error) {
+	return Upgrader{}.Upgrade(conn)
 }
 
 type wsServerConn struct {
 	net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	maxFrameSize int
+	flate        *messageFlate
+	handshake    Handshake
+}
+
+func (w *wsServerConn) Handshake() Handshake {
+	return w.handshake
 }
 
 func (w *wsServerConn) ReadFrame() (Frame, error) {
-	f, err := ws.ReadFrame(w.Conn)
-	if err != nil {
-		return Frame{}, err
-	}
-	f = ws.UnmaskFrameInPlace(f)
-	return Frame{Opcode: OpCode(f.Header.OpCode), Payload: f.Payload}, nil
+	return readMessageFrame(w.r, w.maxFrameSize, w.flate)
 }
 
+// WriteFrame 写入缓冲区, 需调用Flush确保发送
 func (w *wsServerConn) WriteFrame(f Frame) error {
-	frame := ws.NewFrame(ws.OpCode(f.Opcode), true, f.Payload)
-	return ws.WriteFrame(w.Conn, frame)
+	frame, err := w.flate.newFrame(f)
+	if err != nil {
+		return err
+	}
+	return WrapWriteError(ws.WriteFrame(w.w, frame))
 }
 
 func (w *wsServerConn) Flush() error {
-	return nil
+	return WrapWriteError(w.w.Flush())
 }
 
-func NewClientConn(address string) (Conn, error) {
-	dialer := ws.Dialer{}
-	conn, buf, _, err := dialer.Dial(context.Background(), address)
+// Dialer 连接服务端并完成WebSocket握手, 零值可用
+type Dialer struct {
+	// ReadBufferSize 读缓冲区大小, 默认DefaultReadBufferSize
+	ReadBufferSize int
+	// WriteBufferSize 写缓冲区大小, 默认DefaultWriteBufferSize
+	WriteBufferSize int
+	// MaxFrameSize 单帧Payload上限, 默认conn.DefaultMaxFrameSize
+	MaxFrameSize int
+	// Compression 非nil时请求permessage-deflate, 服务端接受后启用
+	Compression *Compression
+	// Protocols 按偏好顺序请求的子协议, 服务端选中的子协议通过conn.HandshakeOf获取
+	Protocols []string
+	// TLSConfig wss://时使用的TLS配置, 未设置ServerName时使用URL中的主机名校验服务端证书
+	// mTLS时在Certificates中设置客户端证书
+	TLSConfig *tls.Config
+	// Header 握手请求中附加的头部, 如Authorization、Cookie
+	Header http.Header
+	// Timeout 建立TCP连接(包括通过代理建立隧道)的超时, 0表示只受ctx限制
+	Timeout time.Duration
+	// HandshakeTimeout TCP连接建立后完成TLS与WebSocket握手的超时, 0表示只受ctx限制
+	HandshakeTimeout time.Duration
+	// LocalAddr 绑定的本地地址, nil时由系统选择
+	LocalAddr net.Addr
+	// Proxy 非nil时通过其返回的代理连接
+	Proxy ProxyFunc
+}
+
+// Dial 等价于DialContext(context.Background(), address)
+func (d Dialer) Dial(address string) (Conn, error) {
+	return d.DialContext(context.Background(), address)
+}
+
+// DialContext 连接address(ws://或wss://)并完成握手, ctx结束时中断连接与握手
+func (d Dialer) DialContext(ctx context.Context, address string) (Conn, error) {
+	readBufferSize := nonZero(d.ReadBufferSize, DefaultReadBufferSize)
+	dialer := ws.Dialer{ReadBufferSize: readBufferSize, Protocols: d.Protocols}
+	if d.Compression != nil {
+		dialer.Extensions = []httphead.Option{d.Compression.parameters().Option()}
+	}
+	if d.Header != nil {
+		dialer.Header = ws.HandshakeHeaderHTTP(d.Header)
+	}
+
+	// 握手超时从TCP连接建立后开始计时, 超时后取消hctx中断握手
+	hctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		timer    *time.Timer
+		timedOut int32
+	)
+	dialer.NetDial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		conn, err := d.dial(ctx, addr)
+		if err == nil && d.HandshakeTimeout > 0 {
+			timer = time.AfterFunc(d.HandshakeTimeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				cancel()
+			})
+		}
+		return conn, err
+	}
+	// 在回调中完成TLS握手, 以便区分TLS握手失败与建立连接失败
+	var tlsErr error
+	dialer.TLSClient = func(conn net.Conn, hostname string) net.Conn {
+		tc, err := ClientTLS(hctx, conn, hostname, d.TLSConfig)
+		if err != nil {
+			// 关闭连接使后续的WebSocket握手立即失败
+			tlsErr = err
+			conn.Close()
+			return conn
+		}
+		return tc
+	}
+	conn, br, hs, err := dialer.Dial(hctx, address)
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, WrapError(ErrHandshakeFailed, errors.Wrap(context.DeadlineExceeded, "handshake timeout"))
+	}
+	if tlsErr != nil {
+		return nil, tlsErr
+	}
 	if err != nil {
-		// TODO: redefine error
-		return nil, err
+		return nil, wrapDialError(err)
+	}
+	fl, err := d.Compression.clientFlate(hs.Extensions)
+	if err != nil {
+		conn.Close()
+		return nil, WrapError(ErrHandshakeFailed, err)
+	}
+	// br不为nil时其中缓存了握手响应之后的数据, 必须继续使用
+	if br == nil {
+		br = bufio.NewReaderSize(conn, readBufferSize)
+	}
+	return &wsClientConn{
+		Conn:         conn,
+		r:            br,
+		w:            bufio.NewWriterSize(conn, nonZero(d.WriteBufferSize, DefaultWriteBufferSize)),
+		maxFrameSize: nonZero(d.MaxFrameSize, DefaultMaxFrameSize),
+		flate:        fl,
+		handshake:    Handshake{Protocol: hs.Protocol, TLS: TLSState(conn)},
+	}, nil
+}
+
+func (d Dialer) dial(ctx context.Context, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
 	}
-	return &wsClientConn{conn, buf}, err
+	return DialTCP(ctx, &net.Dialer{LocalAddr: d.LocalAddr}, d.Proxy, address)
+}
+
+// NewClientConn 等价于Dialer{}.Dial(address)
+func NewClientConn(address string) (Conn, error) {
+	return Dialer{}.Dial(address)
 }
 
 type wsClientConn struct {
 	net.Conn
-	buf *bufio.Reader
+	r            *bufio.Reader
+	w            *bufio.Writer
+	maxFrameSize int
+	flate        *messageFlate
+	handshake    Handshake
+}
+
+func (w *wsClientConn) Handshake() Handshake {
+	return w.handshake
 }
 
 func (w *wsClientConn) ReadFrame() (Frame, error) {
-	var f ws.Frame
-	var err error
-	if w.buf != nil {
-		f, err = ws.ReadFrame(w.buf)
-	} else {
-		f, err = ws.ReadFrame(w.Conn)
-	}
-	if err != nil {
-		return Frame{}, err
-	}
-	return Frame{Opcode: OpCode(f.Header.OpCode), Payload: f.Payload}, nil
+	return readMessageFrame(w.r, w.maxFrameSize, w.flate)
 }
 
+// WriteFrame 写入缓冲区, 需调用Flush确保发送
 func (w *wsClientConn) WriteFrame(f Frame) error {
-	frame := ws.NewFrame(ws.OpCode(f.Opcode), true, f.Payload)
+	frame, err := w.flate.newFrame(f)
+	if err != nil {
+		return err
+	}
 	frame = ws.MaskFrameInPlaceWith(frame, frame.Header.Mask)
-	return ws.WriteFrame(w.Conn, frame)
+	return WrapWriteError(ws.WriteFrame(w.w, frame))
 }
 
 func (w *wsClientConn) Flush() error {
-	return nil
+	return WrapWriteError(w.w.Flush())
+}
+
+// readMessageFrame 读取一帧并去掉掩码, 协商了压缩时解压(压缩消息的分片合并为一帧)
+func readMessageFrame(r io.Reader, maxSize int, fl *messageFlate) (Frame, error) {
+	for {
+		f, err := readFrame(r, maxSize)
+		if err != nil {
+			return Frame{}, wrapReadError(err)
+		}
+		if f.Header.Masked {
+			f = ws.UnmaskFrameInPlace(f)
+		}
+		if fl == nil {
+			return Frame{Opcode: OpCode(f.Header.OpCode), More: !f.Header.Fin, Payload: f.Payload}, nil
+		}
+		frame, ok, err := fl.readFrame(f, maxSize)
+		if err != nil {
+			return Frame{}, wrapReadError(err)
+		}
+		if ok {
+			return frame, nil
+		}
+	}
+}
+
+// readFrame 与ws.ReadFrame相同, 但先检查帧长度, 超过maxSize时返回ErrFrameTooLarge
+func readFrame(r io.Reader, maxSize int) (ws.Frame, error) {
+	h, err := ws.ReadHeader(r)
+	if err != nil {
+		return ws.Frame{}, err
+	}
+	if h.Length > int64(maxSize) {
+		return ws.Frame{}, NewFrameTooLargeError(uint64(h.Length), maxSize)
+	}
+
+	f := ws.Frame{Header: h}
+	if h.Length > 0 {
+		f.Payload = make([]byte, h.Length)
+		if _, err := io.ReadFull(r, f.Payload); err != nil {
+			return ws.Frame{}, err
+		}
+	}
+	return f, nil
+}
+
+func nonZero(a, b int) int {
+	if a > 0 {
+		return a
+	}
+	return b
+}
+
+// wrapReadError 在conn.WrapReadError基础上识别WebSocket协议错误
+func wrapReadError(err error) error {
+	if _, ok := err.(ws.ProtocolError); ok {
+		return WrapError(ErrProtocol, err)
+	}
+	return WrapReadError(err)
+}
+
+// wrapDialError 区分建立连接失败与WebSocket握手失败
+func wrapDialError(err error) error {
+	var (
+		statusErr   ws.StatusError
+		rejectedErr *ws.ConnectionRejectedError
+	)
+	switch {
+	case errors.As(err, &statusErr), errors.As(err, &rejectedErr),
+		errors.Is(err, ws.ErrHandshakeBadStatus),
+		errors.Is(err, ws.ErrHandshakeBadSubProtocol),
+		errors.Is(err, ws.ErrHandshakeBadExtensions):
+		return WrapError(ErrHandshakeFailed, err)
+	}
+	return WrapError(ErrDialFailed, err)
 }
@@ -1,23 +1,33 @@
 package web
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gobwas/ws"
 	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/internal/testcert"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewServerConn_NewClientConn(t *testing.T) {
 	server, err := NewServerConn(&net.TCPConn{})
 	assert.Nil(t, server)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrHandshakeFailed)
 
 	client, err := NewClientConn("")
 	assert.Nil(t, client)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrDialFailed)
 }
 
 func TestWebsocket(t *testing.T) {
@@ -44,6 +54,7 @@ func TestWebsocket(t *testing.T) {
 			err := client.WriteFrame(frame)
 			assert.NoError(t, err)
 		}
+		assert.NoError(t, client.Flush())
 		// 连续读
 		for _, frame := range frames {
 			f, err := client.ReadFrame()
@@ -73,6 +84,7 @@ func TestWebsocket(t *testing.T) {
 		// 回写
 		err = server.WriteFrame(f)
 		assert.NoError(t, err)
+		assert.NoError(t, server.Flush())
 	}
 
 	assert.NoError(t, server.Close())
@@ -102,6 +114,7 @@ func TestServerConnReadFrame_ClientConnWriteFrame(t *testing.T) {
 			err := client.WriteFrame(frame)
 			assert.NoError(t, err)
 		}
+		assert.NoError(t, client.Flush())
 
 		err = client.Close()
 		assert.NoError(t, err)
@@ -127,6 +140,7 @@ func TestServerConnReadFrame_ClientConnWriteFrame(t *testing.T) {
 	f, err := server.ReadFrame()
 	assert.Equal(t, Frame{}, f)
 	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, err, ErrRemoteClosed)
 
 	assert.NoError(t, server.Close())
 }
@@ -179,6 +193,413 @@ func TestServerConnWriteFrame_ClientConnReadFrame(t *testing.T) {
 		err = server.WriteFrame(frame)
 		assert.NoError(t, err)
 	}
+	assert.NoError(t, server.Flush())
 
 	assert.NoError(t, server.Close())
 }
+
+func TestServerConn_MaxFrameSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+
+	go func() {
+		url := fmt.Sprintf("ws://%s/", ln.Addr().String())
+		client, err := NewClientConn(url)
+		assert.NoError(t, err)
+		defer client.Close()
+
+		assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("too large payload")}))
+		assert.NoError(t, client.Flush())
+	}()
+
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, ln.Close())
+
+	server, err := Upgrader{MaxFrameSize: 8}.Upgrade(conn)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	f, err := server.ReadFrame()
+	assert.Equal(t, Frame{}, f)
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+	assert.True(t, IsCloseError(err, CloseMessageTooBig))
+}
+
+func TestFragmentation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+
+	go func() {
+		url := fmt.Sprintf("ws://%s/", ln.Addr().String())
+		client, err := NewClientConn(url)
+		assert.NoError(t, err)
+		defer client.Close()
+
+		assert.NoError(t, WriteMessage(client, Frame{Opcode: OpText, Payload: []byte("hello world")}, 4))
+		assert.NoError(t, client.Flush())
+	}()
+
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, ln.Close())
+
+	server, err := NewServerConn(conn)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	// FIN位与Frame.More对应
+	for _, want := range []Frame{
+		{Opcode: OpText, More: true, Payload: []byte("hell")},
+		{Opcode: OpContinuation, More: true, Payload: []byte("o wo")},
+		{Opcode: OpContinuation, Payload: []byte("rld")},
+	} {
+		f, err := server.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, want, f)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tests := map[string]struct {
+		server     *Compression
+		client     *Compression
+		negotiated bool
+	}{
+		"both":                {&Compression{}, &Compression{}, true},
+		"no context takeover": {&Compression{ServerNoContextTakeover: true}, &Compression{ClientNoContextTakeover: true}, true},
+		"server only":         {&Compression{}, nil, false},
+		"client only":         {nil, &Compression{}, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:")
+			assert.NoError(t, err)
+
+			msg := Frame{Opcode: OpText, Payload: bytes.Repeat([]byte(`{"body":"hello"}`), 64)}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				url := fmt.Sprintf("ws://%s/", ln.Addr().String())
+				client, err := Dialer{Compression: tt.client}.Dial(url)
+				assert.NoError(t, err)
+				defer client.Close()
+				assert.Equal(t, tt.negotiated, client.(*wsClientConn).flate != nil)
+
+				for i := 0; i < 3; i++ {
+					assert.NoError(t, client.WriteFrame(msg))
+					assert.NoError(t, client.Flush())
+					f, err := client.ReadFrame()
+					assert.NoError(t, err)
+					assert.Equal(t, msg, f)
+				}
+			}()
+
+			conn, err := ln.Accept()
+			assert.NoError(t, err)
+			assert.NoError(t, ln.Close())
+
+			server, err := Upgrader{Compression: tt.server}.Upgrade(conn)
+			assert.NoError(t, err)
+			defer server.Close()
+			assert.Equal(t, tt.negotiated, server.(*wsServerConn).flate != nil)
+
+			for i := 0; i < 3; i++ {
+				f, err := server.ReadFrame()
+				assert.NoError(t, err)
+				assert.Equal(t, msg, f)
+				assert.NoError(t, server.WriteFrame(f))
+				assert.NoError(t, server.Flush())
+			}
+			<-done
+		})
+	}
+}
+
+func TestUpgrader_OnRequest(t *testing.T) {
+	u := Upgrader{
+		Protocols: []string{"json", "proto"},
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || origin == "https://example.com"
+		},
+		OnRequest: func(r *http.Request) (Metadata, error) {
+			if r.URL.Path != "/ws" {
+				return nil, Reject(http.StatusNotFound, "not found")
+			}
+			token := r.URL.Query().Get("token")
+			if cookie, err := r.Cookie("token"); err == nil {
+				token = cookie.Value
+			}
+			if token == "" {
+				return nil, errors.New("missing token")
+			}
+			return Metadata{"token": token, "device": r.Header.Get("X-Device")}, nil
+		},
+	}
+
+	tests := map[string]struct {
+		path       string
+		header     http.Header
+		protocols  []string
+		wantStatus int
+		want       Handshake
+	}{
+		"query token": {
+			path:      "/ws?token=abc",
+			header:    http.Header{"X-Device": {"ios"}},
+			protocols: []string{"msgpack", "proto", "json"},
+			want:      Handshake{Protocol: "proto", Metadata: Metadata{"token": "abc", "device": "ios"}},
+		},
+		"cookie token": {
+			path:   "/ws",
+			header: http.Header{"Cookie": {"token=xyz"}, "Origin": {"https://example.com"}},
+			want:   Handshake{Metadata: Metadata{"token": "xyz", "device": ""}},
+		},
+		"origin not allowed": {
+			path:       "/ws?token=abc",
+			header:     http.Header{"Origin": {"https://evil.com"}},
+			wantStatus: http.StatusForbidden,
+		},
+		"rejected with status": {
+			path:       "/other?token=abc",
+			wantStatus: http.StatusNotFound,
+		},
+		"rejected with error": {
+			path:       "/ws",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:")
+			assert.NoError(t, err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(tt.header), Protocols: tt.protocols}
+				conn, _, _, err := dialer.Dial(context.Background(), fmt.Sprintf("ws://%s%s", ln.Addr(), tt.path))
+				if conn != nil {
+					conn.Close()
+				}
+				errCh <- err
+			}()
+
+			conn, err := ln.Accept()
+			assert.NoError(t, err)
+			assert.NoError(t, ln.Close())
+			defer conn.Close()
+
+			server, err := u.Upgrade(conn)
+			dialErr := <-errCh
+			if tt.wantStatus != 0 {
+				assert.ErrorIs(t, err, ErrHandshakeFailed)
+				assert.Equal(t, ws.StatusError(tt.wantStatus), dialErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, dialErr)
+			assert.Equal(t, tt.want, HandshakeOf(server))
+		})
+	}
+}
+
+func TestDialer_Protocols(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+
+	go func() {
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		server, err := Upgrader{Protocols: []string{"json"}}.Upgrade(conn)
+		assert.NoError(t, err)
+		server.Close()
+	}()
+
+	client, err := Dialer{Protocols: []string{"proto", "json"}}.Dial(fmt.Sprintf("ws://%s/", ln.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, Handshake{Protocol: "json"}, HandshakeOf(client))
+	assert.NoError(t, ln.Close())
+}
+
+func TestUpgrader_UpgradeHTTP(t *testing.T) {
+	u := Upgrader{
+		Protocols: []string{"json"},
+		OnRequest: func(r *http.Request) (Metadata, error) {
+			token := r.URL.Query().Get("token")
+			if token == "" {
+				return nil, Reject(http.StatusUnauthorized, "missing token")
+			}
+			return Metadata{"token": token}, nil
+		},
+	}
+	conns := make(chan Conn, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server, err := u.UpgradeHTTP(w, r)
+		if err != nil {
+			return
+		}
+		conns <- server
+	}))
+	defer hs.Close()
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+
+	_, _, _, err := ws.Dial(context.Background(), url)
+	assert.Equal(t, ws.StatusError(http.StatusUnauthorized), err)
+
+	client, err := Dialer{Protocols: []string{"json"}}.Dial(url + "?token=abc")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	server := <-conns
+	defer server.Close()
+	assert.Equal(t, Handshake{Protocol: "json", Metadata: Metadata{"token": "abc"}}, HandshakeOf(server))
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpText, Payload: []byte("hello")}))
+	assert.NoError(t, client.Flush())
+	f, err := server.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, Frame{Opcode: OpText, Payload: []byte("hello")}, f)
+}
+
+func TestTLS(t *testing.T) {
+	certs, err := testcert.New()
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		server        *tls.Config
+		client        *tls.Config
+		wantServerErr bool
+		wantClientErr error
+	}{
+		"wss":  {server: certs.ServerConfig(false), client: certs.ClientConfig(false)},
+		"mtls": {server: certs.ServerConfig(true), client: certs.ClientConfig(true)},
+		// TLS 1.3中客户端证书在客户端握手完成后才被校验, 错误出现在随后的WebSocket握手中
+		"mtls without cert":   {server: certs.ServerConfig(true), client: certs.ClientConfig(false), wantServerErr: true},
+		"untrusted server ca": {server: certs.ServerConfig(false), client: &tls.Config{}, wantServerErr: true, wantClientErr: ErrHandshakeFailed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:")
+			assert.NoError(t, err)
+			defer ln.Close()
+
+			clientErr := make(chan error, 1)
+			go func() {
+				client, err := Dialer{TLSConfig: tt.client}.Dial(fmt.Sprintf("wss://%s/", ln.Addr()))
+				clientErr <- err
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				if err := client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}); err == nil {
+					_ = client.Flush()
+				}
+				_, _ = client.ReadFrame()
+			}()
+
+			conn, err := ln.Accept()
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			server, err := Upgrader{TLSConfig: tt.server}.Upgrade(conn)
+			if tt.wantServerErr {
+				assert.ErrorIs(t, err, ErrHandshakeFailed)
+				conn.Close()
+				err := <-clientErr
+				assert.Error(t, err)
+				if tt.wantClientErr != nil {
+					assert.ErrorIs(t, err, tt.wantClientErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, <-clientErr)
+
+			f, err := server.ReadFrame()
+			assert.NoError(t, err)
+			assert.Equal(t, Frame{Opcode: OpBinary, Payload: []byte("hello")}, f)
+
+			hs := HandshakeOf(server)
+			assert.NotNil(t, hs.TLS)
+			assert.Equal(t, tt.server.ClientAuth == tls.RequireAndVerifyClientCert, len(hs.TLS.PeerCertificates) > 0)
+			server.Close()
+		})
+	}
+}
+
+func TestDialer_Header(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	u := Upgrader{
+		OnRequest: func(r *http.Request) (Metadata, error) {
+			return Metadata{"authorization": r.Header.Get("Authorization")}, nil
+		},
+	}
+	conns := make(chan Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		server, err := u.Upgrade(conn)
+		assert.NoError(t, err)
+		conns <- server
+	}()
+
+	dialer := Dialer{
+		Header:           http.Header{"Authorization": {"Bearer abc"}},
+		Timeout:          time.Second,
+		HandshakeTimeout: time.Second,
+	}
+	client, err := dialer.DialContext(context.Background(), fmt.Sprintf("ws://%s/", ln.Addr()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	server := <-conns
+	defer server.Close()
+	assert.Equal(t, Metadata{"authorization": "Bearer abc"}, HandshakeOf(server).Metadata)
+}
+
+func TestDialer_HandshakeTimeout(t *testing.T) {
+	// 接受连接但不响应握手
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := map[string]struct {
+		dialer     Dialer
+		url        string
+		ctxTimeout time.Duration
+	}{
+		"ws":          {dialer: Dialer{HandshakeTimeout: 50 * time.Millisecond}, url: "ws://%s/"},
+		"wss":         {dialer: Dialer{HandshakeTimeout: 50 * time.Millisecond}, url: "wss://%s/"},
+		"ctx timeout": {url: "ws://%s/", ctxTimeout: 50 * time.Millisecond},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.ctxTimeout > 0 {
+				ctx, cancel = context.WithTimeout(context.Background(), tt.ctxTimeout)
+			}
+			defer cancel()
+
+			start := time.Now()
+			client, err := tt.dialer.DialContext(ctx, fmt.Sprintf(tt.url, ln.Addr()))
+			assert.Nil(t, client)
+			assert.Error(t, err)
+			assert.True(t, IsTimeout(err))
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package comet
+
+import (
+	"github.com/pkg/errors"
+)
+
+// comet层错误, 均可通过errors.Is判断
+// 传输层错误(对端关闭、超时、协议错误等)见conn包: ErrRemoteClosed、ErrTimeout、ErrProtocol...
+var (
+	ErrServerClosed     = errors.New("comet: server closed")
+	ErrChannelClosed    = errors.New("comet: channel closed")
+	ErrChannelFull      = errors.New("comet: channel buffer full")
+	ErrSlowConsumer     = errors.New("comet: slow consumer disconnected")
+	ErrHeartbeatTimeout = errors.New("comet: heartbeat timeout")
+	ErrLoginRejected    = errors.New("comet: login rejected")
+	ErrLoginClosed      = errors.New("comet: remote closed before login")
+	ErrDuplicateLogin   = errors.New("comet: duplicate login")
+	ErrKicked           = errors.New("comet: kicked by new login")
+	ErrStoreFull        = errors.New("comet: message store full")
+	ErrExecutorFull     = errors.New("comet: executor queue full")
+	ErrExecutorClosed   = errors.New("comet: executor closed")
+	ErrPanic            = errors.New("comet: panic recovered")
+)
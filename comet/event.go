@@ -0,0 +1,37 @@
+package comet
+
+import (
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// EventListener Channel生命周期事件, 由Server在连接处理协程中同步调用, 实现不应阻塞
+type EventListener interface {
+	// OnConnect 新连接升级完成, 尚未登录
+	OnConnect(conn Conn)
+	// OnLogin 登录成功, Channel已加入ChannelPool
+	OnLogin(ch Channel)
+	// OnDisconnect Channel已从ChannelPool移除并关闭, reason为断开原因:
+	// 对端关闭为包裹*CloseError的ErrRemoteClosed, 本端关闭为ErrChannelClosed(CloseWithReason时同样包裹*CloseError),
+	// 以及ErrKicked、ErrHeartbeatTimeout、ErrSlowConsumer、*PanicError、读写错误等
+	OnDisconnect(ch Channel, reason error)
+	// OnError 升级失败、登录失败、重复登录被拒绝(ErrDuplicateLogin)或panic, 登录完成前id为空
+	OnError(id string, err error)
+}
+
+// NopEventListener 所有回调为空, 可嵌入后只实现关心的回调
+type NopEventListener struct{}
+
+func (NopEventListener) OnConnect(Conn)              {}
+func (NopEventListener) OnLogin(Channel)             {}
+func (NopEventListener) OnDisconnect(Channel, error) {}
+func (NopEventListener) OnError(string, error)       {}
+
+// disconnectReason 优先使用Channel记录的关闭原因, 否则为ReadLoop返回的错误
+func disconnectReason(ch Channel, err error) error {
+	if c, ok := ch.(interface{ closeCause() error }); ok {
+		if cause := c.closeCause(); cause != nil {
+			return cause
+		}
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package comet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type event struct {
+	name string
+	id   string
+	err  error
+}
+
+type eventRecorder struct {
+	events chan event
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{events: make(chan event, 16)}
+}
+
+func (r *eventRecorder) OnConnect(Conn)     { r.events <- event{name: "connect"} }
+func (r *eventRecorder) OnLogin(ch Channel) { r.events <- event{name: "login", id: ch.ID()} }
+func (r *eventRecorder) OnError(id string, err error) {
+	r.events <- event{name: "error", id: id, err: err}
+}
+func (r *eventRecorder) OnDisconnect(ch Channel, reason error) {
+	r.events <- event{name: "disconnect", id: ch.ID(), err: reason}
+}
+
+func (r *eventRecorder) next(t *testing.T) event {
+	t.Helper()
+	select {
+	case e := <-r.events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("wait event timeout")
+		return event{}
+	}
+}
+
+func loginClient(t *testing.T, addr, token string) Conn {
+	c, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	assert.NoError(t, c.WriteFrame(Frame{Opcode: OpText, Payload: []byte(token)}))
+	assert.NoError(t, c.Flush())
+	return c
+}
+
+func TestServer_EventListener(t *testing.T) {
+	tests := map[string]struct {
+		// close 断开连接, 返回期望的断开原因
+		close func(t *testing.T, s *Server, c Conn) error
+	}{
+		"remote close": {
+			close: func(t *testing.T, s *Server, c Conn) error {
+				assert.NoError(t, c.WriteFrame(NewCloseFrame(CloseNormalClosure, "bye")))
+				assert.NoError(t, c.Flush())
+				return ErrRemoteClosed
+			},
+		},
+		"local close": {
+			close: func(t *testing.T, s *Server, c Conn) error {
+				ch, ok := s.Pool().Get("u1")
+				assert.True(t, ok)
+				assert.NoError(t, ch.Close())
+				return ErrChannelClosed
+			},
+		},
+		"server shutdown": {
+			close: func(t *testing.T, s *Server, c Conn) error {
+				go func() {
+					f, err := c.ReadFrame()
+					if err == nil {
+						_ = c.WriteFrame(f)
+						_ = c.Flush()
+					}
+				}()
+				assert.NoError(t, s.Shutdown(contextWithTimeout(t)))
+				return ErrChannelClosed
+			},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := newEventRecorder()
+			s := NewServer("", tcp.NewServerConn, echoListener{},
+				WithAcceptor(TokenAcceptor(func(token string) (string, error) { return token, nil })),
+				WithEventListener(rec))
+			addr := startServer(t, s)
+			defer s.Shutdown(contextWithTimeout(t))
+
+			c := loginClient(t, addr, "u1")
+			defer c.Close()
+			assert.Equal(t, event{name: "connect"}, rec.next(t))
+			assert.Equal(t, event{name: "login", id: "u1"}, rec.next(t))
+
+			want := tt.close(t, s, c)
+			e := rec.next(t)
+			assert.Equal(t, "disconnect", e.name)
+			assert.Equal(t, "u1", e.id)
+			assert.ErrorIs(t, e.err, want)
+			// Channel已从Pool中移除
+			_, ok := s.Pool().Get("u1")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestServer_EventListener_CloseReason(t *testing.T) {
+	rec := newEventRecorder()
+	s := NewServer("", tcp.NewServerConn, echoListener{},
+		WithAcceptor(TokenAcceptor(func(token string) (string, error) { return token, nil })),
+		WithEventListener(rec),
+		WithChannelOptions(WithHeartbeatInterval(20*time.Millisecond), WithHeartbeatMisses(2)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	// 客户端不回复Pong, 心跳超时
+	c := loginClient(t, addr, "u1")
+	defer c.Close()
+	go func() {
+		for {
+			if _, err := c.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+	rec.next(t)
+	rec.next(t)
+	e := rec.next(t)
+	assert.Equal(t, "disconnect", e.name)
+	assert.ErrorIs(t, e.err, ErrHeartbeatTimeout)
+}
+
+func TestServer_EventListener_Error(t *testing.T) {
+	rec := newEventRecorder()
+	s := NewServer("", tcp.NewServerConn, MessageListenerFunc(func(ag Agent, payload []byte) {
+		panic("listener")
+	}),
+		WithAcceptor(TokenAcceptor(func(token string) (string, error) {
+			if token == "bad" {
+				return "", errors.New("invalid token")
+			}
+			return token, nil
+		})),
+		WithEventListener(rec))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	// 登录失败
+	c := loginClient(t, addr, "bad")
+	defer c.Close()
+	assert.Equal(t, "connect", rec.next(t).name)
+	e := rec.next(t)
+	assert.Equal(t, "error", e.name)
+	assert.Equal(t, "", e.id)
+	assert.ErrorIs(t, e.err, ErrLoginRejected)
+
+	// MessageListener panic
+	c = loginClient(t, addr, "u1")
+	defer c.Close()
+	assert.Equal(t, "connect", rec.next(t).name)
+	assert.Equal(t, "login", rec.next(t).name)
+	assert.NoError(t, c.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, c.Flush())
+	e = rec.next(t)
+	assert.Equal(t, "error", e.name)
+	assert.Equal(t, "u1", e.id)
+	assert.ErrorIs(t, e.err, ErrPanic)
+	assert.Equal(t, CloseInternalServerErr, readCloseCode(t, c))
+	assert.NoError(t, c.WriteFrame(NewCloseFrame(CloseInternalServerErr, "")))
+	assert.NoError(t, c.Flush())
+	e = rec.next(t)
+	assert.Equal(t, "disconnect", e.name)
+	assert.ErrorIs(t, e.err, ErrPanic)
+}
@@ -0,0 +1,173 @@
+package comet
+
+import (
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWorkers 默认执行器的协程数
+	DefaultWorkers = 256
+	// DefaultWorkerQueueSize 默认执行器每个协程的队列长度
+	DefaultWorkerQueueSize = 1024
+	// DefaultExecuteTimeout 默认执行器队列满时Execute的最长等待时间
+	DefaultExecuteTimeout = time.Second * 5
+)
+
+// Executor 执行MessageListener回调, key相同(同一Channel)的任务必须按提交顺序执行
+type Executor interface {
+	Execute(key string, task func()) error
+}
+
+// WorkerPool 固定数量协程的Executor, 按key哈希到协程, 每个协程按FIFO顺序执行自己队列中的任务
+type WorkerPool struct {
+	queues   []chan func()
+	blocking bool
+	timeout  time.Duration
+	onPanic  func(key string, v interface{}, stack []byte)
+	mu       sync.RWMutex
+	closed   bool
+	senders  sync.WaitGroup // 正在入队的Execute
+	wg       sync.WaitGroup
+}
+
+// WorkerPoolOption 配置WorkerPool
+type WorkerPoolOption func(*WorkerPool)
+
+// WithNonBlocking 队列满时Execute立即返回ErrExecutorFull, 默认阻塞等待
+func WithNonBlocking() WorkerPoolOption {
+	return func(p *WorkerPool) {
+		p.blocking = false
+	}
+}
+
+// WithExecuteTimeout 队列满时Execute至多等待d, 超时返回ErrExecutorFull, 默认一直等待
+func WithExecuteTimeout(d time.Duration) WorkerPoolOption {
+	return func(p *WorkerPool) {
+		if d > 0 {
+			p.timeout = d
+		}
+	}
+}
+
+// WithPanicHandler 任务panic时的回调, 协程恢复后继续执行后续任务
+func WithPanicHandler(h func(key string, v interface{}, stack []byte)) WorkerPoolOption {
+	return func(p *WorkerPool) {
+		if h != nil {
+			p.onPanic = h
+		}
+	}
+}
+
+// NewWorkerPool 创建并启动workers个协程, 每个协程的队列至多queueSize个任务
+func NewWorkerPool(workers, queueSize int, opts ...WorkerPoolOption) *WorkerPool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	p := &WorkerPool{
+		queues:   make([]chan func(), workers),
+		blocking: true,
+		onPanic:  func(string, interface{}, []byte) {},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.wg.Add(workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+var (
+	sharedPool     *WorkerPool
+	sharedPoolOnce sync.Once
+)
+
+// sharedWorkerPool 未指定执行器的Channel共用的WorkerPool, 首次使用时启动
+// 积压过多的Channel由WithMaxPending限制并断开, 队列满时短暂等待而不是断开恰好提交任务的无关Channel
+func sharedWorkerPool() *WorkerPool {
+	sharedPoolOnce.Do(func() {
+		sharedPool = NewWorkerPool(DefaultWorkers, DefaultWorkerQueueSize, WithExecuteTimeout(DefaultExecuteTimeout))
+	})
+	return sharedPool
+}
+
+// Execute 提交任务, 队列满时阻塞(WithExecuteTimeout时至多等待超时)或返回ErrExecutorFull(WithNonBlocking),
+// Stop之后返回ErrExecutorClosed
+func (p *WorkerPool) Execute(key string, task func()) error {
+	// 不在持有锁时阻塞入队, 否则Stop等待写锁期间, 任务中再调用Execute会死锁
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrExecutorClosed
+	}
+	p.senders.Add(1)
+	p.mu.RUnlock()
+	defer p.senders.Done()
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	q := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	f := func() {
+		defer func() {
+			if v := recover(); v != nil {
+				p.onPanic(key, v, debug.Stack())
+			}
+		}()
+		task()
+	}
+	if p.blocking && p.timeout == 0 {
+		q <- f
+		return nil
+	}
+	if p.blocking {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		select {
+		case q <- f:
+			return nil
+		case <-timer.C:
+			return ErrExecutorFull
+		}
+	}
+	select {
+	case q <- f:
+		return nil
+	default:
+		return ErrExecutorFull
+	}
+}
+
+func (p *WorkerPool) work(q chan func()) {
+	defer p.wg.Done()
+	for f := range q {
+		f()
+	}
+}
+
+// Stop 不再接受新任务, 等待已提交的任务执行完毕
+func (p *WorkerPool) Stop() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	// 等待已通过检查的Execute入队后再关闭队列
+	p.senders.Wait()
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
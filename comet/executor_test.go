@@ -0,0 +1,269 @@
+package comet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool_Order(t *testing.T) {
+	p := NewWorkerPool(4, 8)
+	defer p.Stop()
+
+	const keys, n = 10, 100
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	var wg sync.WaitGroup
+	wg.Add(keys * n)
+	for i := 0; i < n; i++ {
+		for k := 0; k < keys; k++ {
+			key, i := fmt.Sprint("ch", k), i
+			assert.NoError(t, p.Execute(key, func() {
+				defer wg.Done()
+				mu.Lock()
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			}))
+		}
+	}
+	wg.Wait()
+
+	for k := 0; k < keys; k++ {
+		seq := got[fmt.Sprint("ch", k)]
+		assert.Len(t, seq, n)
+		for i, v := range seq {
+			assert.Equal(t, i, v)
+		}
+	}
+}
+
+func TestWorkerPool_NonBlocking(t *testing.T) {
+	p := NewWorkerPool(1, 1, WithNonBlocking())
+	defer p.Stop()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	assert.NoError(t, p.Execute("ch1", func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.NoError(t, p.Execute("ch1", func() {}))
+	assert.ErrorIs(t, p.Execute("ch1", func() {}), ErrExecutorFull)
+	close(release)
+}
+
+func TestWorkerPool_Panic(t *testing.T) {
+	var panicKey string
+	var panicValue interface{}
+	p := NewWorkerPool(1, 1, WithPanicHandler(func(key string, v interface{}, stack []byte) {
+		panicKey, panicValue = key, v
+		assert.Contains(t, string(stack), "goroutine")
+	}))
+
+	assert.NoError(t, p.Execute("ch1", func() { panic("boom") }))
+	// 协程恢复后继续执行后续任务
+	done := false
+	assert.NoError(t, p.Execute("ch1", func() { done = true }))
+	p.Stop()
+
+	assert.Equal(t, "ch1", panicKey)
+	assert.Equal(t, "boom", panicValue)
+	assert.True(t, done)
+}
+
+func TestWorkerPool_Stop(t *testing.T) {
+	p := NewWorkerPool(2, 16)
+	var mu sync.Mutex
+	count := 0
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, p.Execute(fmt.Sprint(i), func() {
+			mu.Lock()
+			count++
+			mu.Unlock()
+		}))
+	}
+
+	// 已提交的任务执行完毕后返回
+	p.Stop()
+	assert.Equal(t, 10, count)
+	assert.ErrorIs(t, p.Execute("ch1", func() {}), ErrExecutorClosed)
+	p.Stop()
+}
+
+func TestWorkerPool_StopWhileBlocked(t *testing.T) {
+	p := NewWorkerPool(1, 1)
+	started, release := make(chan struct{}), make(chan struct{})
+	assert.NoError(t, p.Execute("a", func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	// 队列已满, 任务中再次提交
+	resubmit := make(chan error, 1)
+	assert.NoError(t, p.Execute("b", func() {
+		resubmit <- p.Execute("b", func() {})
+	}))
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- p.Execute("c", func() {})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	for closed := false; !closed; {
+		p.mu.RLock()
+		closed = p.closed
+		p.mu.RUnlock()
+	}
+	close(release)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop deadlocked")
+	}
+	assert.ErrorIs(t, <-resubmit, ErrExecutorClosed)
+	// 阻塞中的提交在Stop之后完成入队
+	assert.NoError(t, <-blocked)
+}
+
+func TestWorkerPool_ExecuteTimeout(t *testing.T) {
+	p := NewWorkerPool(1, 1, WithExecuteTimeout(20*time.Millisecond))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.NoError(t, p.Execute("a", func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.NoError(t, p.Execute("b", func() {}))
+
+	// 队列已满, 超时后返回
+	assert.ErrorIs(t, p.Execute("c", func() {}), ErrExecutorFull)
+	close(release)
+	p.Stop()
+}
+
+func TestSharedWorkerPool_Timeout(t *testing.T) {
+	p := sharedWorkerPool()
+	assert.True(t, p.blocking)
+	assert.Equal(t, DefaultExecuteTimeout, p.timeout)
+}
+
+type orderListener struct {
+	got chan string
+}
+
+func (l orderListener) Receive(_ Agent, payload []byte) {
+	l.got <- string(payload)
+}
+
+func TestChannel_ExecutorOrder(t *testing.T) {
+	p := NewWorkerPool(4, 4)
+	defer p.Stop()
+
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithExecutor(p))
+	defer ch.Close()
+	lst := orderListener{got: make(chan string, 100)}
+	go ch.ReadLoop(lst)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte(fmt.Sprint(i))}))
+		assert.NoError(t, client.Flush())
+	}
+	for i := 0; i < n; i++ {
+		assert.Equal(t, fmt.Sprint(i), <-lst.got)
+	}
+}
+
+func TestChannel_ExecutorFull(t *testing.T) {
+	p := NewWorkerPool(1, 1, WithNonBlocking())
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		p.Stop()
+	}()
+
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithExecutor(p))
+	started := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ch.ReadLoop(MessageListenerFunc(func(Agent, []byte) {
+			started <- struct{}{}
+			<-release
+		}))
+	}()
+
+	write := func() {
+		assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("payload")}))
+		assert.NoError(t, client.Flush())
+	}
+	// 第1条阻塞在执行中, 第2条在队列中, 第3条无法提交
+	write()
+	<-started
+	write()
+	write()
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseTryAgainLater, code)
+	assert.ErrorIs(t, <-errc, ErrExecutorFull)
+}
+
+func TestChannel_MaxPending(t *testing.T) {
+	// 两个Channel共用一个协程, 队列足够大
+	p := NewWorkerPool(1, 16, WithNonBlocking())
+	defer p.Stop()
+	release := make(chan struct{})
+
+	slowServer, slowClient := newPipeConns(t)
+	defer slowClient.Close()
+	slow := NewChannel("slow", slowServer, WithExecutor(p), WithMaxPending(2))
+	started := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- slow.ReadLoop(MessageListenerFunc(func(Agent, []byte) {
+			started <- struct{}{}
+			<-release
+		}))
+	}()
+
+	fastServer, fastClient := newPipeConns(t)
+	defer fastClient.Close()
+	fast := NewChannel("fast", fastServer, WithExecutor(p), WithMaxPending(2))
+	defer fast.Close()
+	go fast.ReadLoop(echoListener{})
+
+	write := func(c Conn, payload string) {
+		assert.NoError(t, c.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte(payload)}))
+		assert.NoError(t, c.Flush())
+	}
+	// slow: 第1条阻塞在执行中, 第2条在队列中, 第3条超过上限
+	write(slowClient, "1")
+	<-started
+	write(slowClient, "2")
+	write(fastClient, "hello")
+	write(slowClient, "3")
+	assert.Equal(t, CloseTryAgainLater, readCloseCode(t, slowClient))
+	assert.ErrorIs(t, <-errc, ErrExecutorFull)
+
+	// 共用协程的其他Channel不受影响, slow的回调结束后继续处理
+	close(release)
+	f, err := fastClient.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(f.Payload))
+}
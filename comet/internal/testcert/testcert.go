@@ -0,0 +1,102 @@
+// Package testcert 在测试运行时生成自签名CA及其签发的服务端、客户端证书
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Certs 一组测试证书, 服务端证书对localhost与127.0.0.1有效
+type Certs struct {
+	Pool   *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+// New 生成自签名CA, 并用它签发服务端与客户端证书
+func New() (*Certs, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTmpl := template(1, "test ca")
+	caTmpl.IsCA = true
+	caTmpl.BasicConstraintsValid = true
+	caTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	serverTmpl := template(2, "localhost")
+	serverTmpl.DNSNames = []string{"localhost"}
+	serverTmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	serverTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	server, err := issue(serverTmpl, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientTmpl := template(3, "test client")
+	clientTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	client, err := issue(clientTmpl, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &Certs{Pool: pool, Server: server, Client: client}, nil
+}
+
+// ServerConfig 服务端TLS配置, mTLS为true时要求并校验客户端证书
+func (c *Certs) ServerConfig(mTLS bool) *tls.Config {
+	config := &tls.Config{Certificates: []tls.Certificate{c.Server}}
+	if mTLS {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = c.Pool
+	}
+	return config
+}
+
+// ClientConfig 信任测试CA的客户端TLS配置, withCert为true时携带客户端证书
+func (c *Certs) ClientConfig(withCert bool) *tls.Config {
+	config := &tls.Config{RootCAs: c.Pool}
+	if withCert {
+		config.Certificates = []tls.Certificate{c.Client}
+	}
+	return config
+}
+
+func template(serial int64, cn string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+func issue(tmpl, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
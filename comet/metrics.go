@@ -0,0 +1,22 @@
+package comet
+
+import (
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// Metrics Channel运行指标回调, 由使用方对接具体的监控系统
+// 回调在读写协程中同步执行, 实现不应阻塞
+type Metrics interface {
+	// FrameReceived 收到一帧
+	FrameReceived(id string, op OpCode, size int)
+	// FrameSent 写出一帧
+	FrameSent(id string, op OpCode, size int)
+	// PushDropped 缓冲区满, 丢弃一条消息
+	PushDropped(id string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) FrameReceived(string, OpCode, int) {}
+func (nopMetrics) FrameSent(string, OpCode, int)     {}
+func (nopMetrics) PushDropped(string)                {}
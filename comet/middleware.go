@@ -0,0 +1,134 @@
+package comet
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/longyue0521/Tim/comet/packet"
+)
+
+// Recovery 处理函数panic时记录堆栈并回复StatusInternalError, 不影响其他请求
+func Recovery(log Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r *Request) {
+			defer func() {
+				if v := recover(); v != nil {
+					log.Errorf("channel %s command %q panic: %v\n%s", r.Agent.ID(), r.Packet.Command, v, debug.Stack())
+					if _, replied := r.Status(); !replied {
+						_ = r.Reply(packet.StatusInternalError, nil)
+					}
+				}
+			}()
+			next(r)
+		}
+	}
+}
+
+// Logging 记录每个请求的命令、状态与耗时
+func Logging(log Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r *Request) {
+			start := time.Now()
+			next(r)
+			status, replied := r.Status()
+			if !replied {
+				log.Infof("channel %s command %q seq %d no reply in %v", r.Agent.ID(), r.Packet.Command, r.Packet.Sequence, time.Since(start))
+				return
+			}
+			log.Infof("channel %s command %q seq %d %s in %v", r.Agent.ID(), r.Packet.Command, r.Packet.Sequence, status, time.Since(start))
+		}
+	}
+}
+
+// Auth allow返回false时回复StatusUnauthorized, 不再调用后续处理
+// Channel在登录时已完成认证, Auth用于命令级的权限校验
+func Auth(allow func(r *Request) bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r *Request) {
+			if !allow(r) {
+				_ = r.Reply(packet.StatusUnauthorized, nil)
+				return
+			}
+			next(r)
+		}
+	}
+}
+
+// RateLimit 按Agent ID限流的令牌桶, 每秒补充rate个令牌, 最多积累burst个, 超出时回复StatusTooManyRequests
+func RateLimit(rate float64, burst int) Middleware {
+	l := newRateLimiter(rate, burst)
+	return func(next HandlerFunc) HandlerFunc {
+		return func(r *Request) {
+			if !l.allow(r.Agent.ID(), time.Now()) {
+				_ = r.Reply(packet.StatusTooManyRequests, nil)
+				return
+			}
+			next(r)
+		}
+	}
+}
+
+// rateLimitSweepInterval 清理已补满的令牌桶的间隔, 补满的桶与不存在等价
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+func (l *rateLimiter) allow(id string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= rateLimitSweepInterval {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+	if l.refill(b, now) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	return b.tokens
+}
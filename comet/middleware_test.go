@@ -0,0 +1,122 @@
+package comet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/longyue0521/Tim/comet/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) { l.record("debug", format, args...) }
+func (l *recordLogger) Infof(format string, args ...interface{})  { l.record("info", format, args...) }
+func (l *recordLogger) Warnf(format string, args ...interface{})  { l.record("warn", format, args...) }
+func (l *recordLogger) Errorf(format string, args ...interface{}) { l.record("error", format, args...) }
+
+func (l *recordLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestRecovery(t *testing.T) {
+	log := &recordLogger{}
+	rt := NewRouter(packet.JSON)
+	rt.Use(Recovery(log))
+	rt.Handle("panic", func(r *Request) {
+		panic("boom")
+	})
+	ag := &fakeAgent{id: "u1"}
+
+	send(t, rt, ag, &packet.Packet{Command: "panic", Sequence: 1})
+	assert.Equal(t, []packet.Packet{{Command: "panic", Sequence: 1, Status: packet.StatusInternalError}}, ag.replies(t))
+	lines := log.Lines()
+	assert.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "boom")
+	assert.Contains(t, lines[0], "goroutine")
+}
+
+func TestAuth(t *testing.T) {
+	rt := NewRouter(packet.JSON)
+	called := false
+	rt.Handle("admin", func(r *Request) {
+		called = true
+	}, Auth(func(r *Request) bool {
+		return r.Agent.ID() == "admin"
+	}))
+	ag := &fakeAgent{id: "u1"}
+
+	send(t, rt, ag, &packet.Packet{Command: "admin"})
+	assert.Equal(t, []packet.Packet{{Command: "admin", Status: packet.StatusUnauthorized}}, ag.replies(t))
+	assert.False(t, called)
+
+	send(t, rt, &fakeAgent{id: "admin"}, &packet.Packet{Command: "admin"})
+	assert.True(t, called)
+}
+
+func TestRateLimit(t *testing.T) {
+	rt := NewRouter(packet.JSON)
+	rt.Use(RateLimit(0.001, 2))
+	rt.Handle("cmd", func(r *Request) {
+		_ = r.Reply(packet.StatusOK, nil)
+	})
+	u1, u2 := &fakeAgent{id: "u1"}, &fakeAgent{id: "u2"}
+
+	for i := 0; i < 3; i++ {
+		send(t, rt, u1, &packet.Packet{Command: "cmd"})
+	}
+	send(t, rt, u2, &packet.Packet{Command: "cmd"})
+
+	var status []packet.Status
+	for _, p := range u1.replies(t) {
+		status = append(status, p.Status)
+	}
+	assert.Equal(t, []packet.Status{packet.StatusOK, packet.StatusOK, packet.StatusTooManyRequests}, status)
+	// 不同Agent互不影响
+	assert.Equal(t, packet.StatusOK, u2.replies(t)[0].Status)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10, 1)
+	now := time.Now()
+
+	assert.True(t, l.allow("u1", now))
+	assert.False(t, l.allow("u1", now.Add(50*time.Millisecond)))
+	// 100ms补充一个令牌
+	assert.True(t, l.allow("u1", now.Add(150*time.Millisecond)))
+
+	// 补满的令牌桶被定期清理
+	assert.True(t, l.allow("u2", now))
+	assert.True(t, l.allow("u3", now.Add(rateLimitSweepInterval)))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLogging(t *testing.T) {
+	log := &recordLogger{}
+	rt := NewRouter(packet.JSON)
+	rt.Use(Logging(log))
+	rt.Handle("cmd", func(r *Request) {
+		_ = r.Reply(packet.StatusOK, nil)
+	})
+	rt.Handle("silent", func(r *Request) {})
+
+	send(t, rt, &fakeAgent{id: "u1"}, &packet.Packet{Command: "cmd", Sequence: 1})
+	send(t, rt, &fakeAgent{id: "u1"}, &packet.Packet{Command: "silent", Sequence: 2})
+	lines := log.Lines()
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `channel u1 command "cmd" seq 1 ok`)
+	assert.Contains(t, lines[1], `channel u1 command "silent" seq 2 no reply`)
+}
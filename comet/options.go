@@ -0,0 +1,239 @@
+package comet
+
+import (
+	"context"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+const (
+	// DefaultBufferSize Channel待写缓冲区大小
+	DefaultBufferSize = 5
+	// DefaultMaxPending 每个Channel已提交但未执行完的MessageListener回调上限
+	DefaultMaxPending = 64
+	// DefaultHeartbeatMisses 连续多少个Ping未得到回复(期间未收到任何帧)即判定连接失活
+	DefaultHeartbeatMisses = 3
+)
+
+// PushPolicy 缓冲区满时Push的处理策略
+type PushPolicy int
+
+const (
+	// PolicyReject 直接返回ErrChannelFull, 默认策略
+	PolicyReject PushPolicy = iota
+	// PolicyBlock 阻塞等待缓冲区空闲, 超过PushTimeout返回ErrChannelFull
+	PolicyBlock
+	// PolicyDropNewest 丢弃本次Push的消息
+	PolicyDropNewest
+	// PolicyDropOldest 丢弃缓冲区中最早的消息, 为本次Push腾出空间
+	PolicyDropOldest
+	// PolicyDisconnect 认为对端为慢消费者, 关闭Channel
+	PolicyDisconnect
+)
+
+type channelOptions struct {
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	bufferSize        int
+	pushPolicy        PushPolicy
+	pushTimeout       time.Duration
+	closeTimeout      time.Duration
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	maxMessageSize    int
+	fragmentSize      int
+	store             MessageStore
+	retransmitTimeout time.Duration
+	timingWheel       *TimingWheel
+	executor          Executor
+	maxPending        int
+	panicHook         PanicHook
+	logger            Logger
+	metrics           Metrics
+	ctx               context.Context
+}
+
+func defaultChannelOptions() channelOptions {
+	return channelOptions{
+		readTimeout:       DefaultReadTimeout,
+		writeTimeout:      DefaultWriteTimeout,
+		closeTimeout:      DefaultCloseTimeout,
+		bufferSize:        DefaultBufferSize,
+		pushPolicy:        PolicyReject,
+		heartbeatMisses:   DefaultHeartbeatMisses,
+		maxMessageSize:    DefaultMaxMessageSize,
+		retransmitTimeout: DefaultRetransmitTimeout,
+		maxPending:        DefaultMaxPending,
+		logger:            nopLogger{},
+		panicHook:         func(string, *PanicError) {},
+		metrics:           nopMetrics{},
+		ctx:               context.Background(),
+	}
+}
+
+// ChannelOption 配置Channel
+type ChannelOption func(*channelOptions)
+
+// WithReadTimeout 设置读超时, 超过该时间未收到任何帧则ReadLoop返回
+func WithReadTimeout(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		if d > 0 {
+			o.readTimeout = d
+		}
+	}
+}
+
+// WithWriteTimeout 设置单帧写超时
+func WithWriteTimeout(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		if d > 0 {
+			o.writeTimeout = d
+		}
+	}
+}
+
+// WithCloseTimeout 设置CloseWithReason等待对端回复Close帧的最长时间
+func WithCloseTimeout(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		if d > 0 {
+			o.closeTimeout = d
+		}
+	}
+}
+
+// WithBufferSize 设置待写缓冲区大小
+func WithBufferSize(n int) ChannelOption {
+	return func(o *channelOptions) {
+		if n > 0 {
+			o.bufferSize = n
+		}
+	}
+}
+
+// WithPushPolicy 设置缓冲区满时的处理策略
+func WithPushPolicy(p PushPolicy) ChannelOption {
+	return func(o *channelOptions) {
+		o.pushPolicy = p
+	}
+}
+
+// WithPushTimeout 设置PolicyBlock下Push的最长等待时间, 0表示一直等待直到Channel关闭
+func WithPushTimeout(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		o.pushTimeout = d
+	}
+}
+
+// WithHeartbeatInterval 设置心跳间隔, 超过该时间未收到任何帧时主动发送Ping, 0表示不检测
+func WithHeartbeatInterval(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		o.heartbeatInterval = d
+	}
+}
+
+// WithHeartbeatMisses 设置连续未得到回复的Ping数, 达到后的下一个周期关闭Channel
+func WithHeartbeatMisses(n int) ChannelOption {
+	return func(o *channelOptions) {
+		if n > 0 {
+			o.heartbeatMisses = n
+		}
+	}
+}
+
+// WithMaxMessageSize 设置合并分片后单条消息的上限, 超过时以CloseMessageTooBig关闭
+func WithMaxMessageSize(n int) ChannelOption {
+	return func(o *channelOptions) {
+		if n > 0 {
+			o.maxMessageSize = n
+		}
+	}
+}
+
+// WithFragmentSize 设置发送时的分片大小, 超过该大小的消息拆分为多帧发送, 0表示不分片
+func WithFragmentSize(n int) ChannelOption {
+	return func(o *channelOptions) {
+		if n >= 0 {
+			o.fragmentSize = n
+		}
+	}
+}
+
+// WithReliable 启用可靠投递: 消息保存在store中并分配序号, 对端确认后删除, 超时未确认则重传
+// 对端需按conn.SeqMessage格式收发数据帧, 如client.WithReliable
+func WithReliable(store MessageStore) ChannelOption {
+	return func(o *channelOptions) {
+		o.store = store
+	}
+}
+
+// WithRetransmitTimeout 设置可靠投递模式下等待确认的时间
+func WithRetransmitTimeout(d time.Duration) ChannelOption {
+	return func(o *channelOptions) {
+		if d > 0 {
+			o.retransmitTimeout = d
+		}
+	}
+}
+
+// WithTimingWheel 设置心跳与重传检测使用的时间轮, 默认所有Channel共用一个
+func WithTimingWheel(tw *TimingWheel) ChannelOption {
+	return func(o *channelOptions) {
+		o.timingWheel = tw
+	}
+}
+
+// WithExecutor 设置执行MessageListener回调的Executor, 默认所有Channel共用一个WorkerPool,
+// 提交失败(如队列满)时以CloseTryAgainLater关闭Channel
+func WithExecutor(e Executor) ChannelOption {
+	return func(o *channelOptions) {
+		o.executor = e
+	}
+}
+
+// WithMaxPending 设置该Channel已提交但未执行完的回调上限, 超过时以CloseTryAgainLater关闭该Channel,
+// 处理慢或发送过快的Channel被断开, 不影响共用Executor的其他Channel
+func WithMaxPending(n int) ChannelOption {
+	return func(o *channelOptions) {
+		if n > 0 {
+			o.maxPending = n
+		}
+	}
+}
+
+// WithPanicHook 设置panic回调, MessageListener或Channel内部协程panic时,
+// 记录堆栈并调用h, 然后以CloseInternalServerErr关闭该Channel, 不影响其他Channel
+func WithPanicHook(h PanicHook) ChannelOption {
+	return func(o *channelOptions) {
+		if h != nil {
+			o.panicHook = h
+		}
+	}
+}
+
+// WithLogger 设置日志
+func WithLogger(l Logger) ChannelOption {
+	return func(o *channelOptions) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithMetrics 设置指标回调
+func WithMetrics(m Metrics) ChannelOption {
+	return func(o *channelOptions) {
+		if m != nil {
+			o.metrics = m
+		}
+	}
+}
+
+// WithContext 设置父Context, 父Context结束时Channel随之关闭
+func WithContext(ctx context.Context) ChannelOption {
+	return func(o *channelOptions) {
+		if ctx != nil {
+			o.ctx = ctx
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package comet
+
+import (
+	"github.com/longyue0521/Tim/comet/packet"
+)
+
+// PacketHandler 处理解码后的Packet
+type PacketHandler func(ag Agent, p *packet.Packet)
+
+type packetListener struct {
+	codec   packet.Codec
+	handler PacketHandler
+}
+
+// PacketListener 将收到的消息用codec解码为Packet后交给h, 无法解码时回复StatusBadRequest
+func PacketListener(codec packet.Codec, h PacketHandler) MessageListener {
+	return packetListener{codec: codec, handler: h}
+}
+
+func (l packetListener) Receive(ag Agent, payload []byte) {
+	var p packet.Packet
+	if err := l.codec.Unmarshal(payload, &p); err != nil {
+		_ = PushPacket(ag, l.codec, &packet.Packet{Status: packet.StatusBadRequest})
+		return
+	}
+	l.handler(ag, &p)
+}
+
+// PushPacket 用codec编码p后推送给ag
+func PushPacket(ag Agent, codec packet.Codec, p *packet.Packet) error {
+	data, err := codec.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ag.Push(data)
+}
@@ -0,0 +1,213 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Codec Packet与消息之间的编解码
+type Codec interface {
+	// Name 编码名称, 可用作WebSocket子协议
+	Name() string
+	Marshal(p *Packet) ([]byte, error)
+	// Unmarshal 解码data, p.Body可能引用data
+	Unmarshal(data []byte, p *Packet) error
+}
+
+var (
+	// JSON Body为JSON的文本编码:
+	//
+	//	{"command":"chat.send","sequence":1,"status":0,"metadata":{"k":"v"},"body":{...}}
+	JSON Codec = jsonCodec{}
+	// Binary 紧凑的二进制编码, 整数均为大端序:
+	//
+	//	+---------+----------+---------+---------------------+---------------------------+------+
+	//	| version | sequence | status  | command             | metadata                  | body |
+	//	| 1 byte  | 4 bytes  | 2 bytes | uvarint len + bytes | uvarint count + (k, v)... | rest |
+	//	+---------+----------+---------+---------------------+---------------------------+------+
+	//
+	// metadata的key与value均为uvarint长度加内容, 按key排序写出
+	Binary Codec = binaryCodec{}
+)
+
+type jsonPacket struct {
+	Command  string            `json:"command"`
+	Sequence uint32            `json:"sequence,omitempty"`
+	Status   Status            `json:"status,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(p *Packet) ([]byte, error) {
+	if len(p.Body) > 0 && !json.Valid(p.Body) {
+		return nil, errors.Wrap(ErrInvalidPacket, "body is not json")
+	}
+	return json.Marshal(jsonPacket{
+		Command:  p.Command,
+		Sequence: p.Sequence,
+		Status:   p.Status,
+		Metadata: p.Metadata,
+		Body:     p.Body,
+	})
+}
+
+func (jsonCodec) Unmarshal(data []byte, p *Packet) error {
+	var jp jsonPacket
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return errors.Wrap(ErrInvalidPacket, err.Error())
+	}
+	*p = Packet{
+		Command:  jp.Command,
+		Sequence: jp.Sequence,
+		Status:   jp.Status,
+		Metadata: jp.Metadata,
+		Body:     []byte(jp.Body),
+	}
+	return nil
+}
+
+const binaryVersion = 1
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Marshal(p *Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	writeString := func(s string) {
+		n := binary.PutUvarint(tmp[:], uint64(len(s)))
+		buf.Write(tmp[:n])
+		buf.WriteString(s)
+	}
+
+	buf.WriteByte(binaryVersion)
+	binary.BigEndian.PutUint32(tmp[:4], p.Sequence)
+	buf.Write(tmp[:4])
+	binary.BigEndian.PutUint16(tmp[:2], uint16(p.Status))
+	buf.Write(tmp[:2])
+	writeString(p.Command)
+
+	n := binary.PutUvarint(tmp[:], uint64(len(p.Metadata)))
+	buf.Write(tmp[:n])
+	for _, k := range sortedKeys(p.Metadata) {
+		writeString(k)
+		writeString(p.Metadata[k])
+	}
+	buf.Write(p.Body)
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, p *Packet) error {
+	r := binaryReader{data: data}
+	if v := r.byte(); r.err == nil && v != binaryVersion {
+		return errors.Wrapf(ErrInvalidPacket, "unsupported version %d", v)
+	}
+	seq := r.uint32()
+	status := Status(r.uint16())
+	cmd := r.string()
+
+	var md map[string]string
+	if n := r.uvarint(); n > 0 && r.err == nil {
+		// 每对key/value至少2字节, 防止伪造的数量导致大量分配
+		if n > uint64(len(r.data)/2) {
+			return errors.Wrap(ErrInvalidPacket, "invalid metadata count")
+		}
+		md = make(map[string]string, n)
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			k := r.string()
+			md[k] = r.string()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	*p = Packet{
+		Command:  cmd,
+		Sequence: seq,
+		Status:   status,
+		Metadata: md,
+		Body:     r.data,
+	}
+	return nil
+}
+
+// binaryReader 出错后的读取均返回零值, 只需在最后检查err
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errors.Wrap(ErrInvalidPacket, "short packet")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *binaryReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.Wrap(ErrInvalidPacket, "invalid uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = errors.Wrap(ErrInvalidPacket, "short packet")
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,111 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	packets := map[string]*Packet{
+		"request": {
+			Command:  "chat.send",
+			Sequence: 1,
+			Metadata: map[string]string{"trace": "abc", "device": "ios"},
+			Body:     []byte(`{"text":"hi"}`),
+		},
+		"response": {
+			Command:  "chat.send",
+			Sequence: 1<<32 - 1,
+			Status:   StatusNotFound,
+		},
+		"empty": {},
+	}
+	for _, codec := range []Codec{JSON, Binary, MsgPack} {
+		for name, p := range packets {
+			t.Run(codec.Name()+" "+name, func(t *testing.T) {
+				data, err := codec.Marshal(p)
+				assert.NoError(t, err)
+				var got Packet
+				assert.NoError(t, codec.Unmarshal(data, &got))
+				if len(p.Body) == 0 {
+					assert.Empty(t, got.Body)
+					got.Body = p.Body
+				}
+				assert.Equal(t, *p, got)
+			})
+		}
+	}
+}
+
+func TestJSON_Format(t *testing.T) {
+	p := &Packet{Command: "chat.send", Sequence: 2, Body: []byte(`{"text":"hi"}`)}
+	data, err := JSON.Marshal(p)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"command":"chat.send","sequence":2,"body":{"text":"hi"}}`, string(data))
+
+	_, err = JSON.Marshal(&Packet{Body: []byte("not json")})
+	assert.ErrorIs(t, err, ErrInvalidPacket)
+}
+
+func TestBinary_Format(t *testing.T) {
+	p := &Packet{
+		Command:  "ab",
+		Sequence: 258,
+		Status:   StatusBadRequest,
+		Metadata: map[string]string{"k": "v"},
+		Body:     []byte("xyz"),
+	}
+	data, err := Binary.Marshal(p)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		1,          // version
+		0, 0, 1, 2, // sequence
+		1, 0x90, // status
+		2, 'a', 'b', // command
+		1, 1, 'k', 1, 'v', // metadata
+		'x', 'y', 'z', // body
+	}, data)
+}
+
+func TestMsgPack_BinaryBody(t *testing.T) {
+	p := &Packet{Command: "file.upload", Body: []byte{0, 0xff, 0xc1}}
+	data, err := MsgPack.Marshal(p)
+	assert.NoError(t, err)
+	var got Packet
+	assert.NoError(t, MsgPack.Unmarshal(data, &got))
+	assert.Equal(t, *p, got)
+}
+
+func TestCodec_Invalid(t *testing.T) {
+	tests := map[string]struct {
+		codec Codec
+		data  []byte
+	}{
+		"json syntax":            {codec: JSON, data: []byte(`{"command":`)},
+		"binary empty":           {codec: Binary, data: nil},
+		"binary version":         {codec: Binary, data: []byte{2, 0, 0, 0, 0, 0, 0, 0, 0}},
+		"binary short header":    {codec: Binary, data: []byte{1, 0, 0}},
+		"binary short command":   {codec: Binary, data: []byte{1, 0, 0, 0, 0, 0, 0, 5, 'a'}},
+		"binary short metadata":  {codec: Binary, data: []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 1, 'k'}},
+		"binary metadata count":  {codec: Binary, data: []byte{1, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0x03}},
+		"binary invalid uvarint": {codec: Binary, data: []byte{1, 0, 0, 0, 0, 0, 0, 0x80}},
+		"msgpack empty":          {codec: MsgPack, data: nil},
+		"msgpack not map":        {codec: MsgPack, data: []byte{0xc1}},
+		"msgpack short":          {codec: MsgPack, data: []byte{0x81, 0xa7, 'c', 'o', 'm'}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var p Packet
+			assert.ErrorIs(t, tt.codec.Unmarshal(tt.data, &p), ErrInvalidPacket)
+		})
+	}
+}
+
+func TestPacket_Reply(t *testing.T) {
+	req := &Packet{Command: "chat.send", Sequence: 3}
+	req.Set("trace", "abc")
+	assert.Equal(t, "abc", req.Get("trace"))
+	assert.Equal(t, &Packet{Command: "chat.send", Sequence: 3, Status: StatusOK, Body: []byte("ok")},
+		req.Reply(StatusOK, []byte("ok")))
+}
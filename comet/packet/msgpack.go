@@ -0,0 +1,46 @@
+package packet
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgPack MessagePack编码, 字段与JSON相同, Body为bin类型, 可以是任意字节
+var MsgPack Codec = msgpackCodec{}
+
+type msgpackPacket struct {
+	Command  string            `msgpack:"command"`
+	Sequence uint32            `msgpack:"sequence,omitempty"`
+	Status   Status            `msgpack:"status,omitempty"`
+	Metadata map[string]string `msgpack:"metadata,omitempty"`
+	Body     []byte            `msgpack:"body,omitempty"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(p *Packet) ([]byte, error) {
+	return msgpack.Marshal(&msgpackPacket{
+		Command:  p.Command,
+		Sequence: p.Sequence,
+		Status:   p.Status,
+		Metadata: p.Metadata,
+		Body:     p.Body,
+	})
+}
+
+func (msgpackCodec) Unmarshal(data []byte, p *Packet) error {
+	var mp msgpackPacket
+	if err := msgpack.Unmarshal(data, &mp); err != nil {
+		return errors.Wrap(ErrInvalidPacket, err.Error())
+	}
+	*p = Packet{
+		Command:  mp.Command,
+		Sequence: mp.Sequence,
+		Status:   mp.Status,
+		Metadata: mp.Metadata,
+		Body:     mp.Body,
+	}
+	return nil
+}
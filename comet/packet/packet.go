@@ -0,0 +1,77 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidPacket 消息无法解码为Packet, 或Packet无法用当前Codec编码
+var ErrInvalidPacket = errors.New("packet: invalid packet")
+
+// Status 响应状态, 请求中为StatusOK
+type Status uint16
+
+const (
+	StatusOK              Status = 0
+	StatusBadRequest      Status = 400
+	StatusUnauthorized    Status = 401
+	StatusNotFound        Status = 404
+	StatusTooManyRequests Status = 429
+	StatusInternalError   Status = 500
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusUnauthorized:
+		return "unauthorized"
+	case StatusNotFound:
+		return "not found"
+	case StatusTooManyRequests:
+		return "too many requests"
+	case StatusInternalError:
+		return "internal error"
+	}
+	return fmt.Sprintf("status(%d)", uint16(s))
+}
+
+// Packet 应用层消息信封, 路由只需要Command, 不必解析Body
+//
+// 使用JSON编码时Body必须是合法的JSON, 否则Marshal返回ErrInvalidPacket;
+// Body为任意二进制数据时使用Binary或MsgPack编码
+type Packet struct {
+	// Command 命令, 如"chat.send"
+	Command string
+	// Sequence 请求序号, 响应与请求相同, 用于客户端匹配
+	Sequence uint32
+	Status   Status
+	Metadata map[string]string
+	Body     []byte
+}
+
+// Get 返回Metadata中key对应的值
+func (p *Packet) Get(key string) string {
+	return p.Metadata[key]
+}
+
+// Set 设置Metadata
+func (p *Packet) Set(key, value string) {
+	if p.Metadata == nil {
+		p.Metadata = make(map[string]string)
+	}
+	p.Metadata[key] = value
+}
+
+// Reply 创建对p的响应, Command与Sequence与p相同
+func (p *Packet) Reply(status Status, body []byte) *Packet {
+	return &Packet{
+		Command:  p.Command,
+		Sequence: p.Sequence,
+		Status:   status,
+		Body:     body,
+	}
+}
@@ -0,0 +1,54 @@
+package comet
+
+import (
+	"testing"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketListener(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server)
+	defer ch.Close()
+	go ch.ReadLoop(PacketListener(packet.Binary, func(ag Agent, p *packet.Packet) {
+		_ = PushPacket(ag, packet.Binary, p.Reply(packet.StatusOK, append([]byte("re: "), p.Body...)))
+	}))
+
+	send := func(payload []byte) {
+		assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: payload}))
+		assert.NoError(t, client.Flush())
+	}
+	recv := func() packet.Packet {
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		var p packet.Packet
+		assert.NoError(t, packet.Binary.Unmarshal(f.Payload, &p))
+		return p
+	}
+
+	req, err := packet.Binary.Marshal(&packet.Packet{Command: "echo", Sequence: 7, Body: []byte("hi")})
+	assert.NoError(t, err)
+	send(req)
+	assert.Equal(t, packet.Packet{Command: "echo", Sequence: 7, Body: []byte("re: hi")}, recv())
+
+	// 无法解码的消息回复StatusBadRequest
+	send([]byte{0xff})
+	assert.Equal(t, packet.StatusBadRequest, recv().Status)
+}
+
+func TestPushPacket(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server)
+	defer ch.Close()
+
+	assert.NoError(t, PushPacket(ch, packet.JSON, &packet.Packet{Command: "notify", Body: []byte(`{"n":1}`)}))
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"command":"notify","body":{"n":1}}`, string(f.Payload))
+
+	assert.ErrorIs(t, PushPacket(ch, packet.JSON, &packet.Packet{Body: []byte("raw")}), packet.ErrInvalidPacket)
+}
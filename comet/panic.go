@@ -0,0 +1,54 @@
+package comet
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// PanicError 从panic中恢复的错误, 携带panic的值与堆栈, errors.Is(err, ErrPanic)为true
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func newPanicError(v interface{}) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrPanic, e.Value)
+}
+
+func (e *PanicError) Is(target error) bool {
+	return target == ErrPanic
+}
+
+// PanicHook 在panic恢复后调用, id为所在Channel的ID, 登录完成前为空
+type PanicHook func(id string, err *PanicError)
+
+// recoverPanic 记录并上报panic, 须在defer中以c.recoverPanic(recover())的方式调用
+func (c *channel) recoverPanic(v interface{}) *PanicError {
+	if v == nil {
+		return nil
+	}
+	err := newPanicError(v)
+	c.log.Errorf("channel %s %v\n%s", c.id, err, err.Stack)
+	c.setCause(err)
+	c.opts.panicHook(c.id, err)
+	return err
+}
+
+// guard 包装在其他协程(执行器、时间轮)中运行的f, panic时以CloseInternalServerErr关闭Channel
+func (c *channel) guard(f func()) func() {
+	return func() {
+		defer func() {
+			if err := c.recoverPanic(recover()); err != nil {
+				// 不阻塞执行器与时间轮
+				go c.CloseWithReason(CloseInternalServerErr, "internal error")
+			}
+		}()
+		f()
+	}
+}
@@ -0,0 +1,143 @@
+package comet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type panicRecord struct {
+	id  string
+	err *PanicError
+}
+
+func panicRecorder() (PanicHook, chan panicRecord) {
+	ch := make(chan panicRecord, 4)
+	return func(id string, err *PanicError) {
+		ch <- panicRecord{id: id, err: err}
+	}, ch
+}
+
+func readCloseCode(t *testing.T, c Conn) CloseCode {
+	for {
+		f, err := c.ReadFrame()
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		if f.Opcode == OpClose {
+			code, _, err := ParseCloseFrame(f)
+			assert.NoError(t, err)
+			return code
+		}
+	}
+}
+
+func TestChannel_ListenerPanic(t *testing.T) {
+	hook, panics := panicRecorder()
+	lst := MessageListenerFunc(func(ag Agent, payload []byte) {
+		if string(payload) == "boom" {
+			panic("boom")
+		}
+		_ = ag.Push(payload)
+	})
+
+	s1, c1 := newPipeConns(t)
+	defer c1.Close()
+	ch1 := NewChannel("ch1", s1, WithPanicHook(hook))
+	go ch1.ReadLoop(lst)
+	s2, c2 := newPipeConns(t)
+	defer c2.Close()
+	ch2 := NewChannel("ch2", s2, WithPanicHook(hook))
+	defer ch2.Close()
+	go ch2.ReadLoop(lst)
+
+	assert.NoError(t, c1.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("boom")}))
+	assert.NoError(t, c1.Flush())
+	assert.Equal(t, CloseInternalServerErr, readCloseCode(t, c1))
+
+	p := <-panics
+	assert.Equal(t, "ch1", p.id)
+	assert.Equal(t, "boom", p.err.Value)
+	assert.Contains(t, string(p.err.Stack), "goroutine")
+	assert.True(t, errors.Is(p.err, ErrPanic))
+
+	// 其他Channel不受影响
+	assert.NoError(t, c2.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, c2.Flush())
+	f, err := c2.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(f.Payload))
+}
+
+type panicMetrics struct {
+	nopMetrics
+}
+
+func (panicMetrics) FrameReceived(string, OpCode, int) { panic("metrics") }
+
+func TestChannel_ReadLoopPanic(t *testing.T) {
+	hook, panics := panicRecorder()
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("ch1", server, WithPanicHook(hook), WithMetrics(panicMetrics{}))
+	defer ch.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ch.ReadLoop(echoListener{})
+	}()
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, client.Flush())
+	assert.Equal(t, CloseInternalServerErr, readCloseCode(t, client))
+
+	err := <-errc
+	assert.ErrorIs(t, err, ErrPanic)
+	var perr *PanicError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, "metrics", perr.Value)
+	assert.Equal(t, "ch1", (<-panics).id)
+}
+
+func TestServer_AcceptorPanic(t *testing.T) {
+	hook, panics := panicRecorder()
+	s := NewServer("", tcp.NewServerConn, echoListener{},
+		WithAcceptor(TokenAcceptor(func(token string) (string, error) {
+			if token == "panic" {
+				panic("acceptor")
+			}
+			return token, nil
+		})),
+		WithChannelOptions(WithPanicHook(hook)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	login := func(token string) Conn {
+		c, err := tcp.NewClientConn(addr)
+		assert.NoError(t, err)
+		assert.NoError(t, c.WriteFrame(Frame{Opcode: OpText, Payload: []byte(token)}))
+		assert.NoError(t, c.Flush())
+		return c
+	}
+
+	c := login("panic")
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := c.ReadFrame()
+	assert.Error(t, err)
+	p := <-panics
+	assert.Equal(t, "", p.id)
+	assert.Equal(t, "acceptor", p.err.Value)
+
+	// Server继续服务其他连接
+	c = login("u1")
+	defer c.Close()
+	assert.NoError(t, c.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, c.Flush())
+	f, err := c.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(f.Payload))
+}
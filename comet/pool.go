@@ -0,0 +1,210 @@
+package comet
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// DeviceSeparator ConflictMultiDevice策略下Channel ID中用户与设备的分隔符, 如"user-1#ios"
+const DeviceSeparator = "#"
+
+// DeviceID 组合用户与设备作为Channel ID, 多端登录时由Acceptor返回
+func DeviceID(user, device string) string {
+	if device == "" {
+		return user
+	}
+	return user + DeviceSeparator + device
+}
+
+// SplitID 将Channel ID拆分为用户与设备, 不含分隔符时device为空
+func SplitID(id string) (user, device string) {
+	if i := strings.LastIndex(id, DeviceSeparator); i >= 0 {
+		return id[:i], id[i+len(DeviceSeparator):]
+	}
+	return id, ""
+}
+
+// ConflictPolicy 同一用户重复登录时ChannelPool的处理策略
+type ConflictPolicy int
+
+const (
+	// ConflictKickOld 以完整ID为用户, 每个ID只保留一个Channel, 新登录踢掉旧Channel, 默认策略
+	ConflictKickOld ConflictPolicy = iota
+	// ConflictRejectNew 以完整ID为用户, 该ID已有Channel时拒绝新登录
+	ConflictRejectNew
+	// ConflictMultiDevice 按DeviceSeparator将ID拆分为用户+设备(见DeviceID), 不同设备可同时在线, 同一设备重复登录时踢掉旧Channel
+	// 仅此策略下ID中的DeviceSeparator有特殊含义
+	ConflictMultiDevice
+)
+
+// ChannelPool 按ID与用户索引已登录的Channel
+type ChannelPool interface {
+	// Add 按冲突策略加入Channel, ConflictRejectNew下用户已登录时返回ErrDuplicateLogin
+	Add(Channel) error
+	// Del 移除该ID对应的Channel
+	Del(id string)
+	// Remove 仅当该ID对应的仍是ch时移除, 被踢下线的Channel退出时不会误删新登录的Channel
+	Remove(ch Channel) bool
+	Get(id string) (Channel, bool)
+	// GetByUser 返回用户所有设备上的Channel, 非ConflictMultiDevice策略下即Get(user)
+	GetByUser(user string) []Channel
+	All() []Channel
+}
+
+// PoolOption 配置ChannelPool
+type PoolOption func(*pool)
+
+// WithConflictPolicy 设置重复登录的处理策略
+func WithConflictPolicy(p ConflictPolicy) PoolOption {
+	return func(o *pool) {
+		o.policy = p
+	}
+}
+
+// WithKickReason 设置踢下线时发送的关闭码与原因, 默认ClosePolicyViolation, client收到后不再重连
+func WithKickReason(code CloseCode, reason string) PoolOption {
+	return func(o *pool) {
+		o.kickCode, o.kickReason = code, reason
+	}
+}
+
+type pool struct {
+	mu         sync.RWMutex
+	users      map[string]map[string]Channel // user -> id -> Channel
+	policy     ConflictPolicy
+	kickCode   CloseCode
+	kickReason string
+}
+
+// NewChannelPool n为预估的用户数
+func NewChannelPool(n int, opts ...PoolOption) ChannelPool {
+	if n < 0 {
+		n = 0
+	}
+	p := &pool{
+		users:      make(map[string]map[string]Channel, n),
+		policy:     ConflictKickOld,
+		kickCode:   ClosePolicyViolation,
+		kickReason: "duplicate login",
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *pool) Add(c Channel) error {
+	id := c.ID()
+	user := p.userOf(id)
+
+	p.mu.Lock()
+	chs := p.users[user]
+	var kicked []Channel
+	switch p.policy {
+	case ConflictRejectNew:
+		if len(chs) > 0 {
+			p.mu.Unlock()
+			return errors.Wrapf(ErrDuplicateLogin, "user %s", user)
+		}
+	case ConflictMultiDevice:
+		if old, ok := chs[id]; ok && old != c {
+			kicked = append(kicked, old)
+		}
+	default:
+		for key, old := range chs {
+			if old != c {
+				kicked = append(kicked, old)
+			}
+			delete(chs, key)
+		}
+	}
+	if chs == nil {
+		chs = make(map[string]Channel, 1)
+		p.users[user] = chs
+	}
+	chs[id] = c
+	p.mu.Unlock()
+
+	for _, old := range kicked {
+		p.kick(old)
+	}
+	return nil
+}
+
+// userOf 索引用的用户, 仅ConflictMultiDevice下拆分设备
+func (p *pool) userOf(id string) string {
+	if p.policy != ConflictMultiDevice {
+		return id
+	}
+	user, _ := SplitID(id)
+	return user
+}
+
+// kick 以关闭握手断开被踢下线的Channel, 断开原因为ErrKicked
+func (p *pool) kick(ch Channel) {
+	if c, ok := ch.(interface{ setCause(error) }); ok {
+		c.setCause(WrapError(ErrKicked, &CloseError{Code: p.kickCode, Reason: p.kickReason}))
+	}
+	go ch.CloseWithReason(p.kickCode, p.kickReason)
+}
+
+func (p *pool) Del(id string) {
+	user := p.userOf(id)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.delete(user, id)
+}
+
+func (p *pool) Remove(ch Channel) bool {
+	id := ch.ID()
+	user := p.userOf(id)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur, ok := p.users[user][id]; !ok || cur != ch {
+		return false
+	}
+	p.delete(user, id)
+	return true
+}
+
+func (p *pool) delete(user, id string) {
+	chs := p.users[user]
+	delete(chs, id)
+	if len(chs) == 0 {
+		delete(p.users, user)
+	}
+}
+
+func (p *pool) Get(id string) (Channel, bool) {
+	user := p.userOf(id)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ch, ok := p.users[user][id]
+	return ch, ok
+}
+
+func (p *pool) GetByUser(user string) []Channel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	chs := make([]Channel, 0, len(p.users[user]))
+	for _, ch := range p.users[user] {
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+func (p *pool) All() []Channel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	chs := make([]Channel, 0, len(p.users))
+	for _, m := range p.users {
+		for _, ch := range m {
+			chs = append(chs, ch)
+		}
+	}
+	return chs
+}
@@ -0,0 +1,220 @@
+package comet
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeChannel struct {
+	Channel
+	id     string
+	closed chan CloseCode
+}
+
+func newFakeChannel(id string) *fakeChannel {
+	return &fakeChannel{id: id, closed: make(chan CloseCode, 1)}
+}
+
+func (c *fakeChannel) ID() string { return c.id }
+
+func (c *fakeChannel) CloseWithReason(code CloseCode, _ string) error {
+	c.closed <- code
+	return nil
+}
+
+func (c *fakeChannel) kicked() bool {
+	select {
+	case <-c.closed:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestSplitID(t *testing.T) {
+	tests := map[string]struct {
+		id     string
+		user   string
+		device string
+	}{
+		"user only":   {id: "u1", user: "u1"},
+		"with device": {id: DeviceID("u1", "ios"), user: "u1", device: "ios"},
+		"empty":       {id: "", user: ""},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			user, device := SplitID(tt.id)
+			assert.Equal(t, tt.user, user)
+			assert.Equal(t, tt.device, device)
+		})
+	}
+	assert.Equal(t, "u1", DeviceID("u1", ""))
+}
+
+func TestChannelPool_ConflictPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy ConflictPolicy
+		// old 已登录的Channel, add 新登录的Channel
+		old, add string
+		wantErr  error
+		kicked   bool
+		want     []string
+	}{
+		"kick old":             {policy: ConflictKickOld, old: "u1", add: "u1", kicked: true, want: []string{"u1"}},
+		"kick old separator":   {policy: ConflictKickOld, old: "room#1", add: "room#2", want: []string{"room#1"}},
+		"kick old other user":  {policy: ConflictKickOld, old: "u1", add: "u2", want: []string{"u1"}},
+		"reject new":           {policy: ConflictRejectNew, old: "u1", add: "u1", wantErr: ErrDuplicateLogin, want: []string{"u1"}},
+		"reject new separator": {policy: ConflictRejectNew, old: "room#1", add: "room#2", want: []string{"room#1"}},
+		"multi device":         {policy: ConflictMultiDevice, old: "u1#ios", add: "u1#web", want: []string{"u1#ios", "u1#web"}},
+		"multi device same":    {policy: ConflictMultiDevice, old: "u1#ios", add: "u1#ios", kicked: true, want: []string{"u1#ios"}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := NewChannelPool(0, WithConflictPolicy(tt.policy), WithKickReason(4000, "kicked"))
+			old, add := newFakeChannel(tt.old), newFakeChannel(tt.add)
+			assert.NoError(t, p.Add(old))
+
+			assert.ErrorIs(t, p.Add(add), tt.wantErr)
+			assert.Equal(t, tt.kicked, old.kicked())
+			user := tt.old
+			if tt.policy == ConflictMultiDevice {
+				user, _ = SplitID(tt.old)
+			}
+			var ids []string
+			for _, ch := range p.GetByUser(user) {
+				ids = append(ids, ch.ID())
+			}
+			assert.ElementsMatch(t, tt.want, ids)
+		})
+	}
+}
+
+func TestChannelPool_DefaultPolicySeparator(t *testing.T) {
+	p := NewChannelPool(0)
+	room1, room2 := newFakeChannel("room#1"), newFakeChannel("room#2")
+	assert.NoError(t, p.Add(room1))
+	assert.NoError(t, p.Add(room2))
+	assert.False(t, room1.kicked())
+	assert.Len(t, p.All(), 2)
+
+	ch, ok := p.Get("room#1")
+	assert.True(t, ok)
+	assert.Equal(t, room1, ch)
+	assert.True(t, p.Remove(room1))
+	p.Del("room#2")
+	assert.Empty(t, p.All())
+}
+
+func TestChannelPool_Remove(t *testing.T) {
+	p := NewChannelPool(0)
+	old, add := newFakeChannel("u1"), newFakeChannel("u1")
+	assert.NoError(t, p.Add(old))
+	assert.NoError(t, p.Add(add))
+	assert.Equal(t, ClosePolicyViolation, <-old.closed)
+
+	// 被踢下线的Channel退出时不影响新Channel
+	assert.False(t, p.Remove(old))
+	ch, ok := p.Get("u1")
+	assert.True(t, ok)
+	assert.Equal(t, add, ch)
+
+	assert.True(t, p.Remove(add))
+	_, ok = p.Get("u1")
+	assert.False(t, ok)
+	assert.Empty(t, p.GetByUser("u1"))
+	assert.Empty(t, p.All())
+}
+
+func TestServer_DuplicateLogin(t *testing.T) {
+	tests := map[string]struct {
+		policy ConflictPolicy
+		// kickOld 为true时旧连接被踢下线, 否则新连接被拒绝
+		kickOld bool
+	}{
+		"kick old":   {policy: ConflictKickOld, kickOld: true},
+		"reject new": {policy: ConflictRejectNew},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := newEventRecorder()
+			s := NewServer("", tcp.NewServerConn, echoListener{},
+				WithAcceptor(TokenAcceptor(func(token string) (string, error) { return token, nil })),
+				WithChannelPool(NewChannelPool(0, WithConflictPolicy(tt.policy))),
+				WithEventListener(rec))
+			addr := startServer(t, s)
+			defer s.Shutdown(contextWithTimeout(t))
+
+			first := loginClient(t, addr, "u1")
+			defer first.Close()
+			rec.next(t)
+			rec.next(t)
+			second := loginClient(t, addr, "u1")
+			defer second.Close()
+			assert.Equal(t, "connect", rec.next(t).name)
+
+			closed, alive := second, first
+			if tt.kickOld {
+				closed, alive = first, second
+			}
+			// 被断开的一方收到ClosePolicyViolation并回复
+			assert.Equal(t, ClosePolicyViolation, readCloseCode(t, closed))
+			assert.NoError(t, closed.WriteFrame(NewCloseFrame(ClosePolicyViolation, "")))
+			assert.NoError(t, closed.Flush())
+
+			if tt.kickOld {
+				assert.Equal(t, "login", rec.next(t).name)
+				e := rec.next(t)
+				assert.Equal(t, "disconnect", e.name)
+				assert.ErrorIs(t, e.err, ErrKicked)
+			} else {
+				e := rec.next(t)
+				assert.Equal(t, "error", e.name)
+				assert.ErrorIs(t, e.err, ErrDuplicateLogin)
+			}
+
+			// 保留的连接不受影响
+			assert.NoError(t, alive.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+			assert.NoError(t, alive.Flush())
+			f, err := alive.ReadFrame()
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(f.Payload))
+			assert.Len(t, s.Pool().GetByUser("u1"), 1)
+		})
+	}
+}
+
+func TestServer_DuplicateLoginReliable(t *testing.T) {
+	store := NewMemoryStore(0)
+	s := NewServer("", tcp.NewServerConn, echoListener{},
+		WithAcceptor(TokenAcceptor(func(token string) (string, error) { return token, nil })),
+		WithChannelPool(NewChannelPool(0, WithConflictPolicy(ConflictRejectNew))),
+		WithChannelOptions(WithReliable(store)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	first := loginClient(t, addr, "u1")
+	defer first.Close()
+	assert.True(t, waitChannels(s, 1))
+	ch, ok := s.Pool().Get("u1")
+	assert.True(t, ok)
+	assert.NoError(t, ch.Push([]byte("pending")))
+	assert.True(t, waitUnacked(store, "u1", 1))
+
+	// 被拒绝的连接只收到Close帧, 收不到未确认的消息
+	for i := 0; i < 20; i++ {
+		c := loginClient(t, addr, "u1")
+		f, err := c.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, OpClose, f.Opcode)
+		code, _, err := ParseCloseFrame(f)
+		assert.NoError(t, err)
+		assert.Equal(t, ClosePolicyViolation, code)
+		assert.NoError(t, c.Close())
+	}
+	assert.True(t, waitUnacked(store, "u1", 1))
+	assert.Len(t, s.Pool().All(), 1)
+}
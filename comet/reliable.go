@@ -0,0 +1,181 @@
+package comet
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+const (
+	// DefaultRetransmitTimeout 可靠投递模式下等待确认的时间, 超时后从最后确认的序号重新发送
+	DefaultRetransmitTimeout = time.Second * 10
+	// reliableBatchSize 写协程每次从MessageStore取出的消息数
+	reliableBatchSize = 64
+)
+
+// reliable Channel的可靠投递状态
+// 消息先写入MessageStore再通知写协程, 写协程按序号从store取出发送, 因此不受缓冲区策略影响
+type reliable struct {
+	store   MessageStore
+	timeout time.Duration
+	notify  chan struct{}
+
+	mu sync.Mutex
+	// sent 已写出的最大序号, 重传时回退到acked
+	sent uint64
+	// acked 对端确认的最大序号
+	acked uint64
+	// issued 开始写出的最大序号, 不随重传回退, 对端的确认不能超过它
+	issued uint64
+	// progress 最近一次写出消息或收到确认的时间
+	progress time.Time
+}
+
+func newReliable(store MessageStore, timeout time.Duration) *reliable {
+	return &reliable{
+		store:    store,
+		timeout:  timeout,
+		notify:   make(chan struct{}, 1),
+		progress: time.Now(),
+	}
+}
+
+// wakeup 通知写协程发送store中的消息
+func (r *reliable) wakeup() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pushReliable 消息写入store即返回, 由写协程发送
+func (c *channel) pushReliable(payload []byte) error {
+	if _, err := c.rel.store.Append(c.id, payload); err != nil {
+		return err
+	}
+	c.rel.wakeup()
+	return nil
+}
+
+// writeUnacked 在写协程中发送已写出序号之后的消息, 一次至多reliableBatchSize条
+func (c *channel) writeUnacked() error {
+	r := c.rel
+	r.mu.Lock()
+	after := r.sent
+	r.mu.Unlock()
+
+	msgs, err := r.store.Unacked(c.id, after, reliableBatchSize)
+	if err != nil {
+		c.log.Warnf("channel %s load unacked messages: %v", c.id, err)
+		return nil
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	// 先于写出更新, 对端可能在Flush返回前就已收到并确认
+	r.mu.Lock()
+	if last := msgs[len(msgs)-1].Seq; last > r.issued {
+		r.issued = last
+	}
+	r.mu.Unlock()
+	for _, m := range msgs {
+		data := SeqMessage{Kind: SeqData, Seq: m.Seq, Body: m.Payload}
+		if err := c.writePayload(data.Encode()); err != nil {
+			return err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	// 期间发生重传或Resume时sent已被修改, 以修改后的为准
+	if r.sent == after {
+		r.sent = msgs[len(msgs)-1].Seq
+	}
+	r.progress = time.Now()
+	r.mu.Unlock()
+
+	if len(msgs) == reliableBatchSize {
+		r.wakeup()
+	}
+	return nil
+}
+
+// receiveReliable 处理可靠投递模式下收到的数据帧, 返回需要交给MessageListener的消息体
+func (c *channel) receiveReliable(payload []byte) ([]byte, error) {
+	m, err := DecodeSeqMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.rel
+	seq := m.Seq
+	switch m.Kind {
+	case SeqData:
+		return m.Body, nil
+	case SeqAck:
+		r.mu.Lock()
+		// 对端不能确认尚未发送的消息, 否则store会删除对端从未收到的消息
+		if seq > r.issued {
+			seq = r.issued
+		}
+		if seq > r.acked {
+			r.acked = seq
+			r.progress = time.Now()
+		}
+		r.mu.Unlock()
+	case SeqResume:
+		// 新连接尚未发送消息, 以对端记录为准, store据此跳过服务端重启前已分配的序号
+		// 新连接从对端最后确认的序号之后继续发送
+		r.mu.Lock()
+		if m.Seq > r.acked {
+			r.acked = m.Seq
+		}
+		if m.Seq > r.sent {
+			r.sent = m.Seq
+		}
+		if m.Seq > r.issued {
+			r.issued = m.Seq
+		}
+		r.progress = time.Now()
+		r.mu.Unlock()
+		r.wakeup()
+	}
+	if err := r.store.Ack(c.id, seq); err != nil {
+		c.log.Warnf("channel %s ack %d: %v", c.id, seq, err)
+	}
+	return nil, nil
+}
+
+// scheduleRetransmit 在时间轮上登记下一次重传检测
+func (c *channel) scheduleRetransmit() {
+	c.hbMu.Lock()
+	defer c.hbMu.Unlock()
+
+	select {
+	case <-c.ctx.Done():
+		return
+	default:
+	}
+	c.rtTimer = c.opts.timingWheel.AfterFunc(c.rel.timeout, c.guard(c.checkRetransmit))
+}
+
+// checkRetransmit 在时间轮协程中执行, 已发送的消息超时未确认时回退到最后确认的序号重新发送
+func (c *channel) checkRetransmit() {
+	r := c.rel
+	r.mu.Lock()
+	expired := r.sent > r.acked && time.Since(r.progress) >= r.timeout
+	if expired {
+		c.log.Debugf("channel %s retransmit after seq %d", c.id, r.acked)
+		r.sent = r.acked
+		r.progress = time.Now()
+	}
+	r.mu.Unlock()
+
+	if expired {
+		r.wakeup()
+	}
+	c.scheduleRetransmit()
+}
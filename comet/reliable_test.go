@@ -0,0 +1,175 @@
+package comet
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/longyue0521/Tim/comet/client"
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSeq(t *testing.T, c Conn, m SeqMessage) {
+	assert.NoError(t, c.WriteFrame(Frame{Opcode: OpBinary, Payload: m.Encode()}))
+	assert.NoError(t, c.Flush())
+}
+
+func readSeq(t *testing.T, c Conn) SeqMessage {
+	f, err := c.ReadFrame()
+	assert.NoError(t, err)
+	m, err := DecodeSeqMessage(f.Payload)
+	assert.NoError(t, err)
+	return m
+}
+
+func waitUnacked(store MessageStore, id string, n int) bool {
+	for i := 0; i < 100; i++ {
+		if msgs, _ := store.Unacked(id, 0, 0); len(msgs) == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestChannel_Reliable(t *testing.T) {
+	store := NewMemoryStore(0)
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("u1", server, WithReliable(store))
+	defer ch.Close()
+	go ch.ReadLoop(echoListener{})
+
+	// 超过缓冲区大小也不会丢弃
+	const n = 20
+	for i := 1; i <= n; i++ {
+		assert.NoError(t, ch.Push([]byte(fmt.Sprint(i))))
+	}
+	for i := 1; i <= n; i++ {
+		assert.Equal(t, SeqMessage{Kind: SeqData, Seq: uint64(i), Body: []byte(fmt.Sprint(i))}, readSeq(t, client))
+	}
+	assert.True(t, waitUnacked(store, "u1", n))
+
+	writeSeq(t, client, SeqMessage{Kind: SeqAck, Seq: n})
+	assert.True(t, waitUnacked(store, "u1", 0))
+
+	// 上行消息去掉头部后交给MessageListener
+	writeSeq(t, client, SeqMessage{Kind: SeqData, Body: []byte("hi")})
+	assert.Equal(t, SeqMessage{Kind: SeqData, Seq: n + 1, Body: []byte("hi")}, readSeq(t, client))
+}
+
+func TestChannel_Retransmit(t *testing.T) {
+	tw := NewTimingWheel(time.Millisecond, 64)
+	defer tw.Stop()
+
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("u1", server, WithReliable(NewMemoryStore(0)),
+		WithTimingWheel(tw), WithRetransmitTimeout(20*time.Millisecond))
+	defer ch.Close()
+	go ch.ReadLoop(echoListener{})
+
+	assert.NoError(t, ch.Push([]byte("a")))
+	a := SeqMessage{Kind: SeqData, Seq: 1, Body: []byte("a")}
+	assert.Equal(t, a, readSeq(t, client))
+	// 未确认, 超时后重传
+	assert.Equal(t, a, readSeq(t, client))
+
+	writeSeq(t, client, SeqMessage{Kind: SeqAck, Seq: 1})
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, ch.Push([]byte("b")))
+	assert.Equal(t, SeqMessage{Kind: SeqData, Seq: 2, Body: []byte("b")}, readSeq(t, client))
+}
+
+func TestChannel_AckBeyondSent(t *testing.T) {
+	store := NewMemoryStore(0)
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("u1", server, WithReliable(store))
+	defer ch.Close()
+	go ch.ReadLoop(echoListener{})
+
+	assert.NoError(t, ch.Push([]byte("a")))
+	assert.Equal(t, SeqMessage{Kind: SeqData, Seq: 1, Body: []byte("a")}, readSeq(t, client))
+
+	// 确认超过已发送的序号时按已发送处理, 不影响之后的消息
+	writeSeq(t, client, SeqMessage{Kind: SeqAck, Seq: 100})
+	assert.True(t, waitUnacked(store, "u1", 0))
+	assert.NoError(t, ch.Push([]byte("b")))
+	assert.Equal(t, SeqMessage{Kind: SeqData, Seq: 2, Body: []byte("b")}, readSeq(t, client))
+	assert.True(t, waitUnacked(store, "u1", 1))
+}
+
+func TestChannel_ReliableInvalid(t *testing.T) {
+	server, client := newPipeConns(t)
+	defer client.Close()
+	ch := NewChannel("u1", server, WithReliable(NewMemoryStore(0)))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ch.ReadLoop(echoListener{})
+	}()
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("raw")}))
+	assert.NoError(t, client.Flush())
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseInvalidFramePayloadData, code)
+	assert.ErrorIs(t, <-errc, ErrProtocol)
+}
+
+func TestServer_Reliable(t *testing.T) {
+	store := NewMemoryStore(0)
+	s := NewServer("", tcp.NewServerConn, echoListener{},
+		WithAcceptor(TokenAcceptor(verifyToken)),
+		WithChannelOptions(WithReliable(store)))
+	addr := startServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	received := make(chan string, 16)
+	connected := make(chan struct{}, 16)
+	c := client.NewClient(
+		func(ctx context.Context) (Conn, error) {
+			return tcp.Dialer{}.DialContext(ctx, addr)
+		},
+		client.ListenerFunc(func(_ *client.Client, payload []byte) {
+			received <- string(payload)
+		}),
+		client.WithLogin(client.TokenLogin("secret")),
+		client.WithReliable(),
+		client.WithBackoff(client.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+		client.WithStateHook(func(s client.State, _ error) {
+			if s == client.StateConnected {
+				connected <- struct{}{}
+			}
+		}))
+	go c.Run(context.Background())
+	defer c.Close()
+
+	<-connected
+	assert.True(t, waitChannels(s, 1))
+	ch, ok := s.Pool().Get("user-1")
+	assert.True(t, ok)
+	assert.NoError(t, ch.Push([]byte("a")))
+	assert.Equal(t, "a", <-received)
+	assert.True(t, waitUnacked(store, "user-1", 0))
+
+	// 离线期间的消息在重连后送达, 已确认的消息不再重复投递
+	assert.NoError(t, ch.Close())
+	_, err := store.Append("user-1", []byte("b"))
+	assert.NoError(t, err)
+	<-connected
+	select {
+	case msg := <-received:
+		assert.Equal(t, "b", msg)
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+	assert.True(t, waitUnacked(store, "user-1", 0))
+	assert.Equal(t, uint64(2), c.LastSeq())
+	assert.Len(t, received, 0)
+}
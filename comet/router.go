@@ -0,0 +1,118 @@
+package comet
+
+import (
+	"sync"
+
+	"github.com/longyue0521/Tim/comet/packet"
+)
+
+// Request 路由中的一次请求
+type Request struct {
+	Agent  Agent
+	Packet *packet.Packet
+
+	codec   packet.Codec
+	status  packet.Status
+	replied bool
+	values  map[string]interface{}
+}
+
+// Reply 向发起请求的Agent回复响应, Command与Sequence与请求相同
+func (r *Request) Reply(status packet.Status, body []byte) error {
+	r.status, r.replied = status, true
+	return PushPacket(r.Agent, r.codec, r.Packet.Reply(status, body))
+}
+
+// Status 返回已回复的状态, 未回复时ok为false
+func (r *Request) Status() (status packet.Status, ok bool) {
+	return r.status, r.replied
+}
+
+// Set 保存中间件与处理函数之间传递的数据
+func (r *Request) Set(key string, value interface{}) {
+	if r.values == nil {
+		r.values = make(map[string]interface{})
+	}
+	r.values[key] = value
+}
+
+// Get 返回Set保存的数据
+func (r *Request) Get(key string) (interface{}, bool) {
+	v, ok := r.values[key]
+	return v, ok
+}
+
+// HandlerFunc 处理一个命令
+type HandlerFunc func(r *Request)
+
+// Middleware 包装HandlerFunc, 可以在调用next前后执行逻辑或直接回复而不调用next
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router 按Packet的Command分发消息的MessageListener
+// 消息用codec解码, 无法解码时回复StatusBadRequest, 没有对应处理函数时回复StatusNotFound
+type Router struct {
+	codec       packet.Codec
+	mu          sync.RWMutex
+	handlers    map[string]HandlerFunc
+	middlewares []Middleware
+	notFound    HandlerFunc
+}
+
+// NewRouter 创建使用codec编解码的Router
+func NewRouter(codec packet.Codec) *Router {
+	return &Router{
+		codec:    codec,
+		handlers: make(map[string]HandlerFunc),
+		notFound: func(r *Request) {
+			_ = r.Reply(packet.StatusNotFound, nil)
+		},
+	}
+}
+
+// Use 添加对所有命令生效的中间件, 按添加顺序由外到内执行
+func (rt *Router) Use(mws ...Middleware) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.middlewares = append(rt.middlewares, mws...)
+}
+
+// Handle 注册command的处理函数, mws只对该命令生效, 在Use添加的中间件之后执行
+func (rt *Router) Handle(command string, h HandlerFunc, mws ...Middleware) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.handlers[command] = chain(h, mws)
+}
+
+// NotFound 设置没有对应处理函数时的处理, 同样经过Use添加的中间件
+func (rt *Router) NotFound(h HandlerFunc) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.notFound = h
+}
+
+// Receive 实现MessageListener
+func (rt *Router) Receive(ag Agent, payload []byte) {
+	var p packet.Packet
+	if err := rt.codec.Unmarshal(payload, &p); err != nil {
+		_ = PushPacket(ag, rt.codec, &packet.Packet{Status: packet.StatusBadRequest})
+		return
+	}
+
+	rt.mu.RLock()
+	h, ok := rt.handlers[p.Command]
+	if !ok {
+		h = rt.notFound
+	}
+	h = chain(h, rt.middlewares)
+	rt.mu.RUnlock()
+
+	h(&Request{Agent: ag, Packet: &p, codec: rt.codec})
+}
+
+// chain mws[0]在最外层
+func chain(h HandlerFunc, mws []Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
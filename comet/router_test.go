@@ -0,0 +1,135 @@
+package comet
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/longyue0521/Tim/comet/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAgent struct {
+	id     string
+	mu     sync.Mutex
+	pushed [][]byte
+}
+
+func (a *fakeAgent) ID() string { return a.id }
+
+func (a *fakeAgent) Push(payload []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pushed = append(a.pushed, payload)
+	return nil
+}
+
+// replies 解码并清空已推送的消息
+func (a *fakeAgent) replies(t *testing.T) []packet.Packet {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ps []packet.Packet
+	for _, data := range a.pushed {
+		var p packet.Packet
+		assert.NoError(t, packet.JSON.Unmarshal(data, &p))
+		ps = append(ps, p)
+	}
+	a.pushed = nil
+	return ps
+}
+
+func send(t *testing.T, rt *Router, ag Agent, p *packet.Packet) {
+	data, err := packet.JSON.Marshal(p)
+	assert.NoError(t, err)
+	rt.Receive(ag, data)
+}
+
+func TestRouter(t *testing.T) {
+	rt := NewRouter(packet.JSON)
+	rt.Handle("echo", func(r *Request) {
+		_ = r.Reply(packet.StatusOK, r.Packet.Body)
+	})
+	ag := &fakeAgent{id: "u1"}
+
+	tests := map[string]struct {
+		payload []byte
+		want    packet.Packet
+	}{
+		"dispatch": {
+			payload: []byte(`{"command":"echo","sequence":1,"body":{"text":"hi"}}`),
+			want:    packet.Packet{Command: "echo", Sequence: 1, Body: []byte(`{"text":"hi"}`)},
+		},
+		"not found": {
+			payload: []byte(`{"command":"unknown","sequence":2}`),
+			want:    packet.Packet{Command: "unknown", Sequence: 2, Status: packet.StatusNotFound},
+		},
+		"bad request": {
+			payload: []byte(`not json`),
+			want:    packet.Packet{Status: packet.StatusBadRequest},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rt.Receive(ag, tt.payload)
+			ps := ag.replies(t)
+			assert.Len(t, ps, 1)
+			ps[0].Body = nilIfEmpty(ps[0].Body)
+			assert.Equal(t, tt.want, ps[0])
+		})
+	}
+}
+
+func nilIfEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+func TestRouter_NotFound(t *testing.T) {
+	rt := NewRouter(packet.JSON)
+	rt.NotFound(func(r *Request) {
+		_ = r.Reply(packet.StatusBadRequest, []byte(`"unsupported"`))
+	})
+	ag := &fakeAgent{id: "u1"}
+
+	send(t, rt, ag, &packet.Packet{Command: "unknown"})
+	assert.Equal(t, []packet.Packet{{Command: "unknown", Status: packet.StatusBadRequest, Body: []byte(`"unsupported"`)}}, ag.replies(t))
+}
+
+func TestRouter_Middleware(t *testing.T) {
+	var trace []string
+	mark := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(r *Request) {
+				trace = append(trace, name+" before")
+				next(r)
+				trace = append(trace, name+" after")
+			}
+		}
+	}
+
+	rt := NewRouter(packet.JSON)
+	rt.Use(mark("m1"), mark("m2"))
+	rt.Handle("cmd", func(r *Request) {
+		v, _ := r.Get("user")
+		trace = append(trace, fmt.Sprint("handler ", v))
+	}, mark("route"), func(next HandlerFunc) HandlerFunc {
+		return func(r *Request) {
+			r.Set("user", r.Agent.ID())
+			next(r)
+		}
+	})
+
+	send(t, rt, &fakeAgent{id: "u1"}, &packet.Packet{Command: "cmd"})
+	assert.Equal(t, []string{
+		"m1 before", "m2 before", "route before",
+		"handler u1",
+		"route after", "m2 after", "m1 after",
+	}, trace)
+
+	// 全局中间件同样作用于NotFound
+	trace = nil
+	send(t, rt, &fakeAgent{id: "u1"}, &packet.Packet{Command: "unknown"})
+	assert.Equal(t, []string{"m1 before", "m2 before", "m2 after", "m1 after"}, trace)
+}
@@ -0,0 +1,370 @@
+package comet
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+)
+
+// Upgrader 将Accept得到的net.Conn升级为Conn, 如tcp.NewServerConn、web.NewServerConn
+type Upgrader func(net.Conn) (Conn, error)
+
+// HTTPUpgrader 在http.Handler中升级连接, 如web.Upgrader{}.UpgradeHTTP
+// 失败时由HTTPUpgrader负责写出HTTP响应
+type HTTPUpgrader func(w http.ResponseWriter, r *http.Request) (Conn, error)
+
+const (
+	// DefaultHandshakeTimeout 升级(握手)阶段的超时时间
+	DefaultHandshakeTimeout = time.Second * 10
+)
+
+// ServerOption 配置Server
+type ServerOption func(*Server)
+
+// WithAcceptor 设置登录认证器, 默认不认证并为每个连接生成唯一ID
+func WithAcceptor(a Acceptor) ServerOption {
+	return func(s *Server) {
+		s.acceptor = a
+	}
+}
+
+// WithLoginTimeout 设置新连接完成登录的超时时间
+func WithLoginTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.loginTimeout = d
+	}
+}
+
+// WithChannelOptions 设置Server创建Channel时使用的选项
+func WithChannelOptions(opts ...ChannelOption) ServerOption {
+	return func(s *Server) {
+		s.channelOpts = append(s.channelOpts, opts...)
+	}
+}
+
+// WithChannelPool 设置ChannelPool, 可通过NewChannelPool的选项配置重复登录策略
+func WithChannelPool(p ChannelPool) ServerOption {
+	return func(s *Server) {
+		if p != nil {
+			s.pool = p
+		}
+	}
+}
+
+// WithEventListener 设置Channel生命周期事件回调
+func WithEventListener(l EventListener) ServerOption {
+	return func(s *Server) {
+		if l != nil {
+			s.events = l
+		}
+	}
+}
+
+// Server 负责监听端口、升级连接、维护Channel的整个生命周期
+type Server struct {
+	address      string
+	upgrade      Upgrader
+	listener     MessageListener
+	acceptor     Acceptor
+	loginTimeout time.Duration
+	channelOpts  []ChannelOption
+	pool         ChannelPool
+	log          Logger
+	panicHook    PanicHook
+	events       EventListener
+
+	mu       sync.Mutex
+	ln       net.Listener
+	closed   bool
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func NewServer(address string, upgrade Upgrader, lst MessageListener, opts ...ServerOption) *Server {
+	s := &Server{
+		address:      address,
+		upgrade:      upgrade,
+		listener:     lst,
+		acceptor:     defaultAcceptor{},
+		loginTimeout: DefaultLoginTimeout,
+		pool:         NewChannelPool(0),
+		events:       NopEventListener{},
+		quit:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// 登录完成前的日志与panic回调与Channel一致
+	o := defaultChannelOptions()
+	for _, opt := range s.channelOpts {
+		opt(&o)
+	}
+	s.log, s.panicHook = o.logger, o.panicHook
+	// Channel的panic同样上报给EventListener
+	s.channelOpts = append(s.channelOpts, WithPanicHook(s.onPanic))
+	return s
+}
+
+// Pool 返回Server管理的ChannelPool
+func (s *Server) Pool() ChannelPool { return s.pool }
+
+// Addr 返回监听地址, Serve之前返回nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// ListenAndServe 监听address并阻塞处理连接, ctx结束时优雅关闭Server
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return errors.Wrapf(err, "comet: listen %s", s.address)
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve 在ln上循环Accept, 直到ctx结束或调用Shutdown
+// ctx结束时等同于调用Shutdown: 向所有Channel发起关闭握手, Channel本身不继承ctx,
+// 并等待所有连接处理完毕后才返回; 调用Shutdown时Serve立即返回, 由Shutdown等待
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if s.upgrade == nil || s.listener == nil {
+		return errors.New("comet: upgrader and listener must not be nil")
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	// stopped ctx结束触发的Shutdown已完成
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Shutdown(context.Background())
+			close(stopped)
+		case <-done:
+		}
+	}()
+	// done在返回后才关闭, ctx已结束时监听协程必然在执行Shutdown, 等待其完成
+	serverClosed := func() error {
+		if ctx.Err() != nil {
+			<-stopped
+		}
+		return ErrServerClosed
+	}
+
+	var delay time.Duration
+	for {
+		rawConn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return serverClosed()
+			default:
+			}
+			// 临时错误, 退避后重试
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		// 与Shutdown互斥, 保证Wait开始后不再Add
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			rawConn.Close()
+			return serverClosed()
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(rawConn)
+	}
+}
+
+func (s *Server) serveConn(rawConn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		if s.recoverPanic(recover()) {
+			rawConn.Close()
+		}
+	}()
+
+	// 升级阶段设置超时, 防止恶意连接一直占用
+	_ = rawConn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout))
+	conn, err := s.upgrade(rawConn)
+	if err != nil {
+		s.events.OnError("", errors.Wrapf(err, "comet: upgrade %s", rawConn.RemoteAddr()))
+		rawConn.Close()
+		return
+	}
+	_ = rawConn.SetDeadline(time.Time{})
+
+	s.serveChannel(conn)
+}
+
+// Handler 返回将请求升级后交给Server处理的http.Handler, 可与其他路由挂载在同一端口
+// 已升级的连接由Shutdown关闭, Shutdown之后的请求返回503
+func (s *Server) Handler(upgrade HTTPUpgrader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			http.Error(w, ErrServerClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		defer s.wg.Done()
+
+		conn, err := upgrade(w, r)
+		if err != nil {
+			s.events.OnError("", errors.Wrapf(err, "comet: upgrade %s", r.RemoteAddr))
+			return
+		}
+		// 劫持后的连接可能残留http.Server设置的超时
+		_ = conn.SetDeadline(time.Time{})
+
+		s.serveChannel(conn)
+	})
+}
+
+// serveChannel 登录认证后创建Channel并阻塞在ReadLoop上, 返回时关闭连接
+func (s *Server) serveChannel(conn Conn) {
+	defer func() {
+		if s.recoverPanic(recover()) {
+			conn.Close()
+		}
+	}()
+
+	s.events.OnConnect(conn)
+	id, err := s.acceptor.Accept(conn, s.loginTimeout)
+	if err != nil {
+		s.events.OnError("", errors.Wrapf(err, "comet: login %s", conn.RemoteAddr()))
+		// 帧过大等错误携带了关闭码, 其余按认证失败处理
+		code := ClosePolicyViolation
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			code = ce.Code
+		}
+		rejectConn(conn, code, err.Error())
+		return
+	}
+
+	// 不使用Serve的ctx作为父Context, 否则ctx结束时Channel直接断开, 来不及发送Close帧
+	// 加入ChannelPool成功后才启动, 被拒绝的重复登录不会收到离线消息或心跳
+	ch := newChannel(id, conn, s.channelOpts...)
+	if err := s.pool.Add(ch); err != nil {
+		s.events.OnError(id, err)
+		ch.ctxCancel()
+		rejectConn(conn, ClosePolicyViolation, err.Error())
+		return
+	}
+	ch.start()
+	s.events.OnLogin(ch)
+
+	reason := ErrServerClosed
+	defer func() {
+		// 被踢下线时池中可能已是同ID的新Channel
+		s.pool.Remove(ch)
+		ch.Close()
+		s.events.OnDisconnect(ch, reason)
+	}()
+
+	// Shutdown可能发生在Add之前, 此时Channel不会被Shutdown关闭
+	select {
+	case <-s.quit:
+		return
+	default:
+	}
+
+	err = ch.ReadLoop(s.listener)
+	reason = disconnectReason(ch, err)
+}
+
+// rejectConn 拒绝登录: 发送Close帧后直接关闭连接
+func rejectConn(conn Conn, code CloseCode, reason string) {
+	if err := conn.WriteFrame(NewCloseFrame(code, reason)); err == nil {
+		_ = conn.Flush()
+	}
+	conn.Close()
+}
+
+// recoverPanic 记录并上报升级、登录阶段的panic, 须在defer中以s.recoverPanic(recover())的方式调用
+func (s *Server) recoverPanic(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	err := newPanicError(v)
+	s.log.Errorf("serve connection %v\n%s", err, err.Stack)
+	s.onPanic("", err)
+	return true
+}
+
+// onPanic 调用PanicHook并上报给EventListener
+func (s *Server) onPanic(id string, err *PanicError) {
+	s.panicHook(id, err)
+	s.events.OnError(id, err)
+}
+
+// Shutdown 停止Accept并关闭所有Channel, 等待连接处理协程退出或ctx结束
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	ln := s.ln
+	s.mu.Unlock()
+
+	var err error
+	s.quitOnce.Do(func() {
+		close(s.quit)
+		if ln != nil {
+			err = ln.Close()
+		}
+	})
+
+	for _, ch := range s.pool.All() {
+		go ch.CloseWithReason(CloseGoingAway, "server shutdown")
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
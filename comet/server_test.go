@@ -0,0 +1,287 @@
+package comet
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/longyue0521/Tim/comet/conn"
+	"github.com/longyue0521/Tim/comet/conn/tcp"
+	"github.com/longyue0521/Tim/comet/conn/web"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoListener struct{}
+
+func (echoListener) Receive(ag Agent, payload []byte) {
+	_ = ag.Push(payload)
+}
+
+func startServer(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+
+	go func() {
+		_ = s.Serve(context.Background(), ln)
+	}()
+	return ln.Addr().String()
+}
+
+func contextWithTimeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func waitChannels(s *Server, n int) bool {
+	for i := 0; i < 100; i++ {
+		if len(s.Pool().All()) == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestServer_Echo(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{})
+	addr := startServer(t, s)
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+
+	frames := []Frame{
+		{Opcode: OpBinary, Payload: []byte("hello")},
+		{Opcode: OpBinary, Payload: []byte("comet")},
+	}
+	for _, frame := range frames {
+		assert.NoError(t, client.WriteFrame(frame))
+		assert.NoError(t, client.Flush())
+		f, err := client.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, frame, f)
+	}
+	assert.True(t, waitChannels(s, 1))
+
+	// 客户端断开后Channel从Pool中移除
+	assert.NoError(t, client.Close())
+	assert.True(t, waitChannels(s, 0))
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{})
+	addr := startServer(t, s)
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	assert.True(t, waitChannels(s, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Shutdown(ctx)
+	}()
+
+	// 服务端发起关闭握手, 客户端回复Close帧
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseGoingAway, code)
+	assert.NoError(t, client.WriteFrame(NewCloseFrame(code, "")))
+	assert.NoError(t, client.Flush())
+
+	assert.NoError(t, <-errCh)
+	assert.Empty(t, s.Pool().All())
+
+	// 服务端关闭后客户端读到错误
+	_, err = client.ReadFrame()
+	assert.Error(t, err)
+	assert.NoError(t, client.Close())
+
+	// 关闭后不再接受新连接
+	_, err = tcp.NewClientConn(addr)
+	assert.Error(t, err)
+}
+
+func TestServer_ListenAndServe_ContextCancel(t *testing.T) {
+	s := NewServer("127.0.0.1:", tcp.NewServerConn, echoListener{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe(ctx)
+	}()
+
+	for i := 0; i < 100 && s.Addr() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, s.Addr())
+
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return after context canceled")
+	}
+}
+
+func TestServer_ContextCancel_GracefulClose(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{})
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ctx, ln)
+	}()
+
+	client, err := tcp.NewClientConn(ln.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, waitChannels(s, 1))
+
+	// ctx结束后客户端先收到CloseGoingAway, 而不是直接断开
+	cancel()
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseGoingAway, code)
+	assert.NoError(t, client.WriteFrame(NewCloseFrame(code, "")))
+	assert.NoError(t, client.Flush())
+
+	// Serve返回时所有Channel已完成关闭
+	assert.ErrorIs(t, <-errCh, ErrServerClosed)
+	assert.Empty(t, s.Pool().All())
+}
+
+// lateListener 模拟Shutdown关闭监听时Accept恰好返回了新连接
+type lateListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l lateListener) Accept() (net.Conn, error) { return <-l.conns, nil }
+func (l lateListener) Close() error              { return nil }
+
+func TestServer_AcceptAfterShutdown(t *testing.T) {
+	s := NewServer("", tcp.NewServerConn, echoListener{})
+	inner, err := net.Listen("tcp", "127.0.0.1:")
+	assert.NoError(t, err)
+	defer inner.Close()
+	ln := lateListener{Listener: inner, conns: make(chan net.Conn)}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(context.Background(), ln)
+	}()
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(t, s.Shutdown(contextWithTimeout(t)))
+
+	// Shutdown之后Accept到的连接直接关闭, 不再交给处理协程
+	server, client := net.Pipe()
+	ln.conns <- server
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, ErrServerClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServer_HeartbeatTimeout(t *testing.T) {
+	tw := NewTimingWheel(time.Millisecond, 64)
+	defer tw.Stop()
+
+	s := NewServer("", tcp.NewServerConn, echoListener{}, WithChannelOptions(
+		WithTimingWheel(tw), WithHeartbeatInterval(10*time.Millisecond), WithHeartbeatMisses(2)))
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, waitChannels(s, 1))
+
+	// 客户端不读也不回复Pong, 失活的Channel从Pool中移除
+	assert.True(t, waitChannels(s, 0))
+}
+
+func TestServer_MaxFrameSize(t *testing.T) {
+	s := NewServer("", tcp.Upgrader{MaxFrameSize: 8}.Upgrade, echoListener{})
+	addr := startServer(t, s)
+	defer s.Shutdown(contextWithTimeout(t))
+
+	client, err := tcp.NewClientConn(addr)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("too large payload")}))
+	assert.NoError(t, client.Flush())
+
+	// 服务端回复1009后断开
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	code, _, err := ParseCloseFrame(f)
+	assert.NoError(t, err)
+	assert.Equal(t, CloseMessageTooBig, code)
+	assert.True(t, waitChannels(s, 0))
+}
+
+func TestServer_Handler(t *testing.T) {
+	s := NewServer("", nil, echoListener{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.Handle("/ws", s.Handler(web.Upgrader{}.UpgradeHTTP))
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/ws"
+	client, err := web.NewClientConn(url)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.True(t, waitChannels(s, 1))
+
+	assert.NoError(t, client.WriteFrame(Frame{Opcode: OpBinary, Payload: []byte("hello")}))
+	assert.NoError(t, client.Flush())
+	f, err := client.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), f.Payload)
+
+	// 其他路由不受影响
+	resp, err := http.Get(hs.URL + "/healthz")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+
+	// Shutdown关闭经由Handler建立的Channel
+	go func() {
+		f, err := client.ReadFrame()
+		if err == nil && f.Opcode == OpClose {
+			_ = client.WriteFrame(NewCloseFrame(CloseGoingAway, ""))
+			_ = client.Flush()
+		}
+	}()
+	assert.NoError(t, s.Shutdown(contextWithTimeout(t)))
+	assert.Empty(t, s.Pool().All())
+
+	_, err = web.NewClientConn(url)
+	assert.ErrorIs(t, err, ErrHandshakeFailed)
+}
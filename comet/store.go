@@ -0,0 +1,110 @@
+package comet
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultStoreCapacity 内存MessageStore中每个ID默认保存的未确认消息数
+const DefaultStoreCapacity = 1024
+
+// StoredMessage 可靠投递模式下保存的一条消息
+type StoredMessage struct {
+	Seq     uint64
+	Payload []byte
+}
+
+// MessageStore 保存可靠投递模式下未确认的消息, 以Channel ID为键,
+// 连接断开后消息依然保留, 同一ID再次登录时继续投递
+// 实现需要并发安全
+type MessageStore interface {
+	// Append 为消息分配序号并保存, 同一ID的序号从1开始递增
+	Append(id string, payload []byte) (uint64, error)
+	// Ack 删除seq及之前的消息
+	// Channel只在收到Resume时传入大于已分配序号的seq(如服务端重启后内存数据丢失), 之后分配的序号应大于seq
+	Ack(id string, seq uint64) error
+	// Unacked 按序号递增返回seq之后的未确认消息, 至多limit条
+	Unacked(id string, seq uint64, limit int) ([]StoredMessage, error)
+}
+
+type memoryQueue struct {
+	next uint64
+	msgs []StoredMessage
+}
+
+type memoryStore struct {
+	mu       sync.Mutex
+	capacity int
+	queues   map[string]*memoryQueue
+}
+
+// NewMemoryStore 创建内存MessageStore, 每个ID至多保存capacity条未确认消息, 超过时Append返回ErrStoreFull
+// capacity<=0时使用DefaultStoreCapacity, 服务端重启后消息丢失
+func NewMemoryStore(capacity int) MessageStore {
+	if capacity <= 0 {
+		capacity = DefaultStoreCapacity
+	}
+	return &memoryStore{
+		capacity: capacity,
+		queues:   make(map[string]*memoryQueue),
+	}
+}
+
+func (s *memoryStore) queue(id string) *memoryQueue {
+	q, ok := s.queues[id]
+	if !ok {
+		q = &memoryQueue{next: 1}
+		s.queues[id] = q
+	}
+	return q
+}
+
+func (s *memoryStore) Append(id string, payload []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(id)
+	if len(q.msgs) >= s.capacity {
+		return 0, ErrStoreFull
+	}
+	// 序号不能回绕到0, 0表示无需确认
+	if q.next == math.MaxUint64 {
+		return 0, errors.Wrapf(ErrStoreFull, "sequence of %s exhausted", id)
+	}
+	seq := q.next
+	q.next++
+	q.msgs = append(q.msgs, StoredMessage{Seq: seq, Payload: payload})
+	return seq, nil
+}
+
+func (s *memoryStore) Ack(id string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(id)
+	if seq >= q.next && seq < math.MaxUint64 {
+		q.next = seq + 1
+	}
+	n := sort.Search(len(q.msgs), func(i int) bool { return q.msgs[i].Seq > seq })
+	q.msgs = append(q.msgs[:0], q.msgs[n:]...)
+	return nil
+}
+
+func (s *memoryStore) Unacked(id string, seq uint64, limit int) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.queues[id]
+	if !ok {
+		return nil, nil
+	}
+	n := sort.Search(len(q.msgs), func(i int) bool { return q.msgs[i].Seq > seq })
+	msgs := q.msgs[n:]
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return append([]StoredMessage(nil), msgs...), nil
+}
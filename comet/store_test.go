@@ -0,0 +1,59 @@
+package comet
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(3)
+
+	for i := 1; i <= 3; i++ {
+		seq, err := s.Append("u1", []byte{byte(i)})
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), seq)
+	}
+	_, err := s.Append("u1", []byte{4})
+	assert.ErrorIs(t, err, ErrStoreFull)
+
+	// 不同ID的序号相互独立
+	seq, err := s.Append("u2", []byte{1})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	msgs, err := s.Unacked("u1", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredMessage{{Seq: 2, Payload: []byte{2}}, {Seq: 3, Payload: []byte{3}}}, msgs)
+	msgs, err = s.Unacked("u1", 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredMessage{{Seq: 1, Payload: []byte{1}}}, msgs)
+
+	assert.NoError(t, s.Ack("u1", 2))
+	msgs, err = s.Unacked("u1", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []StoredMessage{{Seq: 3, Payload: []byte{3}}}, msgs)
+	seq, err = s.Append("u1", []byte{4})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+
+	// 确认了更大的序号(如服务端重启), 之后的序号从其后分配
+	assert.NoError(t, s.Ack("u3", 100))
+	seq, err = s.Append("u3", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(101), seq)
+
+	// 序号不会回绕到0
+	assert.NoError(t, s.Ack("u4", math.MaxUint64))
+	seq, err = s.Append("u4", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+	assert.NoError(t, s.Ack("u5", math.MaxUint64-1))
+	_, err = s.Append("u5", nil)
+	assert.ErrorIs(t, err, ErrStoreFull)
+
+	msgs, err = s.Unacked("unknown", 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
@@ -0,0 +1,140 @@
+package comet
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWheelTick 默认时间轮的刻度
+	DefaultWheelTick = time.Millisecond * 100
+	// DefaultWheelSize 默认时间轮的槽数, 一圈为DefaultWheelTick*DefaultWheelSize
+	DefaultWheelSize = 600
+)
+
+// TimingWheel 单层哈希时间轮, 所有定时任务共享一个time.Ticker,
+// 适合大量连接的心跳检测等对精度要求不高的场景
+// 回调在时间轮协程中串行执行, 不应阻塞
+type TimingWheel struct {
+	tick  time.Duration
+	slots []map[*Timer]struct{}
+	pos   int
+	mu    sync.Mutex
+	quit  chan struct{}
+	once  sync.Once
+}
+
+// Timer 时间轮上的一个定时任务
+type Timer struct {
+	tw     *TimingWheel
+	slot   int
+	rounds int
+	f      func()
+}
+
+// NewTimingWheel 创建并启动时间轮
+func NewTimingWheel(tick time.Duration, size int) *TimingWheel {
+	if tick <= 0 {
+		tick = DefaultWheelTick
+	}
+	if size <= 0 {
+		size = DefaultWheelSize
+	}
+	tw := &TimingWheel{
+		tick:  tick,
+		slots: make([]map[*Timer]struct{}, size),
+		quit:  make(chan struct{}),
+	}
+	for i := range tw.slots {
+		tw.slots[i] = make(map[*Timer]struct{})
+	}
+	go tw.run()
+	return tw
+}
+
+var (
+	sharedWheel     *TimingWheel
+	sharedWheelOnce sync.Once
+)
+
+// sharedTimingWheel 未指定时间轮的Channel共用的时间轮, 首次使用时启动
+func sharedTimingWheel() *TimingWheel {
+	sharedWheelOnce.Do(func() {
+		sharedWheel = NewTimingWheel(DefaultWheelTick, DefaultWheelSize)
+	})
+	return sharedWheel
+}
+
+// AfterFunc 在d之后执行f, 精度为一个tick
+func (tw *TimingWheel) AfterFunc(d time.Duration, f func()) *Timer {
+	ticks := int((d + tw.tick - 1) / tw.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	t := &Timer{
+		tw:     tw,
+		slot:   (tw.pos + ticks) % len(tw.slots),
+		rounds: (ticks - 1) / len(tw.slots),
+		f:      f,
+	}
+	tw.slots[t.slot][t] = struct{}{}
+	return t
+}
+
+// Stop 取消定时任务, 任务已执行或已取消时返回false
+func (t *Timer) Stop() bool {
+	t.tw.mu.Lock()
+	defer t.tw.mu.Unlock()
+
+	if _, ok := t.tw.slots[t.slot][t]; !ok {
+		return false
+	}
+	delete(t.tw.slots[t.slot], t)
+	return true
+}
+
+// Stop 停止时间轮, 未执行的任务不再执行
+func (tw *TimingWheel) Stop() {
+	tw.once.Do(func() {
+		close(tw.quit)
+	})
+}
+
+func (tw *TimingWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tw.advance()
+		case <-tw.quit:
+			return
+		}
+	}
+}
+
+func (tw *TimingWheel) advance() {
+	tw.mu.Lock()
+	tw.pos = (tw.pos + 1) % len(tw.slots)
+	slot := tw.slots[tw.pos]
+	var expired []*Timer
+	for t := range slot {
+		if t.rounds > 0 {
+			t.rounds--
+			continue
+		}
+		delete(slot, t)
+		expired = append(expired, t)
+	}
+	tw.mu.Unlock()
+
+	// 释放锁后执行, 回调中可以再次AfterFunc
+	for _, t := range expired {
+		t.f()
+	}
+}
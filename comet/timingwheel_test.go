@@ -0,0 +1,55 @@
+package comet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimingWheel_AfterFunc(t *testing.T) {
+	tw := NewTimingWheel(time.Millisecond, 8)
+	defer tw.Stop()
+
+	tests := map[string]struct {
+		d time.Duration
+	}{
+		"less than a tick":  {d: 0},
+		"within one round":  {d: 5 * time.Millisecond},
+		"exactly one round": {d: 8 * time.Millisecond},
+		"more than a round": {d: 20 * time.Millisecond},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			done := make(chan time.Duration, 1)
+			tw.AfterFunc(tt.d, func() {
+				done <- time.Since(start)
+			})
+
+			select {
+			case elapsed := <-done:
+				// 精度为一个tick
+				assert.GreaterOrEqual(t, int64(elapsed), int64(tt.d-time.Millisecond))
+			case <-time.After(time.Second):
+				t.Fatal("timer did not fire")
+			}
+		})
+	}
+}
+
+func TestTimer_Stop(t *testing.T) {
+	tw := NewTimingWheel(time.Millisecond, 8)
+	defer tw.Stop()
+
+	var fired int32
+	timer := tw.AfterFunc(10*time.Millisecond, func() {
+		atomic.StoreInt32(&fired, 1)
+	})
+	assert.True(t, timer.Stop())
+	assert.False(t, timer.Stop())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fired))
+}
@@ -3,9 +3,11 @@ module github.com/longyue0521/Tim
 go 1.16
 
 require (
+	github.com/gobwas/httphead v0.1.0 // direct
 	github.com/gobwas/ws v1.1.0 // direct
 	github.com/pkg/errors v0.9.1 // direct
 	github.com/segmentio/ksuid v1.0.4 // direct
 	github.com/stretchr/testify v1.7.0 // direct
+	github.com/vmihailenco/msgpack/v5 v5.4.1 // direct
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // direct
 )